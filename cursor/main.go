@@ -1,53 +1,95 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"runtime"
-	"sort"
+	"syscall"
+	"time"
 
 	"indexer/pkg/cache"
+	"indexer/pkg/client"
+	"indexer/pkg/format"
 	"indexer/pkg/indexer"
+	"indexer/pkg/query"
 	"indexer/pkg/search"
+	"indexer/pkg/server"
+	"indexer/pkg/watch"
 )
 
+// indexEnv selects an index when --index is not given
+const indexEnv = "INDEXER_INDEX"
+
+// socketName is the default name of the daemon socket in an index's directory
+const socketName = "indexer.sock"
+
 const usage = `Usage:
   indexer index <directory_path>  - Index files in the specified directory
-  indexer search <keyword>        - Search for keyword in indexed files`
+  indexer index --explain <file>  - Explain why a file is indexed or skipped
+  indexer search <keyword>        - Search for keyword in indexed files
+  indexer search --regex <pattern> - Search for a regular expression in indexed files
+  indexer search --query [--scope file|line] <query>
+                                  - Search with a boolean query, e.g. 'foo AND -"bar baz" ext:go'
+  indexer search --rank ...        - Order matching files by BM25 relevance
+  indexer search -A/-B/-C <n> ... - Print n lines of context after/before/around matches
+  indexer search --format <fmt> ... - Print results as text, json, jsonl, csv or vimgrep
+                                  (--json is short for --format json)
+  indexer search --jobs <n> ...   - Search with n workers (default: one per CPU)
+  indexer search --timeout <d> ... - Give up on the search after d, e.g. 500ms or 2s
+  indexer watch <directory_path>  - Index a directory and keep the index up to date as files change
+  indexer serve [--addr 127.0.0.1:8080] [--allow-new-roots]
+                                  - Serve the index over HTTP (/search, /files, /stats, /reindex)
+  indexer daemon                  - Keep the index in memory and answer index and search
+                                  commands over a Unix socket
+  indexer cache convert [--gzip]  - Rewrite the cache in the binary format, optionally compressed
+  indexer cache info              - Show the cache's format version, the indexer version that
+                                  wrote it, when, and its roots
+  indexer roots                   - List the indexed directories
+  indexer forget <directory_path> - Remove a directory from the index
+  indexer indexes list            - List the saved indexes
+  indexer indexes delete <name>   - Delete an index
+  indexer indexes rename <old> <new> - Rename an index
+
+Global flags (before the command):
+  --cache-dir <path>              - Directory holding the indexes. Defaults to $INDEXER_CACHE_DIR,
+                                  then a .indexer directory in the working directory or a
+                                  parent, then $XDG_CACHE_HOME/indexer, then ~/.cache/indexer
+  --index <name>                  - Use a separate named index (default $INDEXER_INDEX, or "default")
+  --socket <path>                 - Unix socket of the daemon (default indexer.sock in the
+                                  index's directory, the cache directory for the default index)
+  --no-daemon                     - Do not use a running daemon
+  --no-wait                       - Fail straight away, naming its PID, when another indexer
+                                  process is using the cache instead of waiting for it
+  --log-level <level>             - Log debug, info (default), warn or error messages to stderr
+  --log-format text|json          - Format of log messages (default text)`
 
 func main() {
 	// Initialize components
-	home, err := os.UserHomeDir()
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error getting home directory: %v\n", err)
-		os.Exit(1)
-	}
-
-	cacheDir := filepath.Join(home, ".cache", "indexer")
 	idx := indexer.NewIndex(runtime.NumCPU())
-	cache := cache.NewCache(cacheDir)
 
-	// Load cached data
-	fmt.Println("Loading cache...")
-	data, err := cache.Load()
-	if err != nil {
-		fmt.Printf("Warning: could not load cache: %v\n", err)
-	} else {
-		validFiles := 0
-		for path, entry := range data {
-			if _, err := os.Stat(path); err == nil {
-				idx.GetFiles()[path] = entry
-				validFiles++
-			}
-		}
-		fmt.Printf("Loaded %d valid files from cache\n", validFiles)
+	defaultIndex := os.Getenv(indexEnv)
+	if defaultIndex == "" {
+		defaultIndex = cache.DefaultIndex
 	}
 
 	flag.Usage = func() {
 		fmt.Fprintln(os.Stderr, usage)
 	}
+	cacheDirFlag := flag.String("cache-dir", "", "Keep indexes in `directory`")
+	indexName := flag.String("index", defaultIndex, "Use the index called `name`")
+	socketPath := flag.String("socket", "", "Unix `socket` of the daemon")
+	noDaemon := flag.Bool("no-daemon", false, "Do not use a running daemon")
+	noWait := flag.Bool("no-wait", false, "Fail if another process holds the cache lock")
+	logLevel := flag.String("log-level", "info", "Log messages of at least `level`: debug, info, warn or error")
+	logFormat := flag.String("log-format", "text", "Log `format`: text or json")
 	flag.Parse()
 
 	if flag.NArg() < 1 {
@@ -55,26 +97,220 @@ func main() {
 		os.Exit(1)
 	}
 
+	// Diagnostics go to stderr, above the progress line while indexing, so
+	// that stdout only carries results
+	progress := newProgressPrinter(os.Stderr)
+	handler, err := newLogHandler(progress, *logLevel, *logFormat)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	slog.SetDefault(slog.New(handler))
+
 	command := flag.Arg(0)
 
+	cacheDir, err := cache.ResolveDir(*cacheDirFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	indexes := cache.NewIndexes(cacheDir)
+	indexes.Wait = !*noWait
+	c, err := indexes.Open(*indexName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if *socketPath == "" {
+		*socketPath = filepath.Join(indexes.Dir(*indexName), socketName)
+	}
+
+	// Commands load the cache only when they need it, and index and search
+	// skip it entirely when a daemon holds the index. Searching and serving
+	// drop entries for missing files up front; indexing detects and reports
+	// their removal itself.
+	var daemon *client.Client
+	if !*noDaemon {
+		if cl := client.New(*socketPath); cl.Available() {
+			daemon = cl
+		}
+	}
+
 	switch command {
 	case "index":
-		if flag.NArg() != 2 {
+		indexCmd := flag.NewFlagSet("index", flag.ExitOnError)
+		indexCmd.Usage = flag.Usage
+		explain := indexCmd.String("explain", "", "Explain why `file` is indexed or skipped instead of indexing")
+		indexCmd.Parse(flag.Args()[1:])
+
+		if *explain != "" {
+			loadCache(idx, c, false)
+			handleExplain(*explain, idx)
+			return
+		}
+		if indexCmd.NArg() != 1 {
 			fmt.Fprintln(os.Stderr, "Error: index command requires a directory path")
 			flag.Usage()
 			os.Exit(1)
 		}
-		dirPath := flag.Arg(1)
-		handleIndex(dirPath, idx, cache)
+		dirPath := indexCmd.Arg(0)
+		if daemon != nil {
+			handleDaemonIndex(dirPath, daemon)
+			return
+		}
+		// Hold the lock from loading to saving so that parallel runs do not
+		// overwrite each other's changes
+		lockCache(c)
+		loadCache(idx, c, false)
+		handleIndex(dirPath, idx, c, progress)
 
 	case "search":
-		if flag.NArg() != 2 {
+		searchCmd := flag.NewFlagSet("search", flag.ExitOnError)
+		searchCmd.Usage = flag.Usage
+		regex := searchCmd.Bool("regex", false, "Treat the keyword as a regular expression")
+		useQuery := searchCmd.Bool("query", false, "Treat the keyword as a boolean query")
+		scopeName := searchCmd.String("scope", "file", "Scope at which query operators combine matches: file or line")
+		rank := searchCmd.Bool("rank", false, "Order files by BM25 relevance instead of by path")
+		jobs := searchCmd.Int("jobs", runtime.NumCPU(), "Search with `N` workers")
+		timeout := searchCmd.Duration("timeout", 0, "Give up on the search after `duration`, e.g. 500ms or 10s (0 for no limit)")
+		after := searchCmd.Int("A", 0, "Print `N` lines of context after each match")
+		before := searchCmd.Int("B", 0, "Print `N` lines of context before each match")
+		contextLines := searchCmd.Int("C", 0, "Print `N` lines of context around each match")
+		formatName := searchCmd.String("format", "text", "Output `format`: text, json, jsonl, csv or vimgrep")
+		asJSON := searchCmd.Bool("json", false, "Shorthand for --format json")
+		searchCmd.Parse(flag.Args()[1:])
+
+		if searchCmd.NArg() != 1 {
 			fmt.Fprintln(os.Stderr, "Error: search command requires a keyword")
 			flag.Usage()
 			os.Exit(1)
 		}
-		keyword := flag.Arg(1)
-		handleSearch(keyword, idx)
+		if *regex && *useQuery {
+			fmt.Fprintln(os.Stderr, "Error: --regex and --query cannot be combined")
+			os.Exit(1)
+		}
+		scope, err := query.ParseScope(*scopeName)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		if *asJSON {
+			*formatName = string(format.JSON)
+		}
+		outputFormat, err := format.Parse(*formatName)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		opts := searchOptions{
+			Options: query.Options{
+				Mode:  query.KeywordMode,
+				Scope: scope,
+				Rank:  *rank,
+				Jobs:  *jobs,
+			},
+			before:  max(*before, *contextLines),
+			after:   max(*after, *contextLines),
+			format:  outputFormat,
+			timeout: *timeout,
+		}
+		switch {
+		case *regex:
+			opts.Mode = query.RegexMode
+		case *useQuery:
+			opts.Mode = query.QueryMode
+		}
+		if daemon == nil {
+			loadCache(idx, c, true)
+		}
+		handleSearch(searchCmd.Arg(0), opts, idx, daemon)
+
+	case "watch":
+		if flag.NArg() != 2 {
+			fmt.Fprintln(os.Stderr, "Error: watch command requires a directory path")
+			flag.Usage()
+			os.Exit(1)
+		}
+		dirPath := flag.Arg(1)
+		loadCache(idx, c, false)
+		handleWatch(dirPath, idx, c)
+
+	case "serve":
+		serveCmd := flag.NewFlagSet("serve", flag.ExitOnError)
+		serveCmd.Usage = flag.Usage
+		addr := serveCmd.String("addr", "127.0.0.1:8080", "Listen `address`")
+		allowNewRoots := serveCmd.Bool("allow-new-roots", false, "Let /reindex index directories that are not roots yet")
+		serveCmd.Parse(flag.Args()[1:])
+
+		if serveCmd.NArg() != 0 {
+			fmt.Fprintln(os.Stderr, "Error: serve command takes no arguments")
+			flag.Usage()
+			os.Exit(1)
+		}
+		loadCache(idx, c, true)
+		handleServe(*addr, *allowNewRoots, idx, c)
+
+	case "daemon":
+		if flag.NArg() != 1 {
+			fmt.Fprintln(os.Stderr, "Error: daemon command takes no arguments")
+			flag.Usage()
+			os.Exit(1)
+		}
+		if daemon != nil {
+			fmt.Fprintf(os.Stderr, "Error: a daemon is already listening on %s\n", *socketPath)
+			os.Exit(1)
+		}
+		loadCache(idx, c, true)
+		handleDaemon(*socketPath, idx, c)
+
+	case "cache":
+		if flag.NArg() == 2 && flag.Arg(1) == "info" {
+			handleCacheInfo(c)
+			return
+		}
+		if flag.NArg() < 2 || flag.Arg(1) != "convert" {
+			fmt.Fprintln(os.Stderr, "Error: cache command requires the convert or info subcommand")
+			flag.Usage()
+			os.Exit(1)
+		}
+		convertCmd := flag.NewFlagSet("cache convert", flag.ExitOnError)
+		convertCmd.Usage = flag.Usage
+		compress := convertCmd.Bool("gzip", false, "Compress the cache with gzip")
+		convertCmd.Parse(flag.Args()[2:])
+
+		if convertCmd.NArg() != 0 {
+			fmt.Fprintln(os.Stderr, "Error: cache convert takes no arguments")
+			flag.Usage()
+			os.Exit(1)
+		}
+		handleCacheConvert(*compress, c)
+
+	case "roots":
+		if flag.NArg() != 1 {
+			fmt.Fprintln(os.Stderr, "Error: roots command takes no arguments")
+			flag.Usage()
+			os.Exit(1)
+		}
+		if daemon == nil {
+			loadCache(idx, c, false)
+		}
+		handleRoots(idx, daemon)
+
+	case "indexes":
+		handleIndexes(flag.Args()[1:], indexes)
+
+	case "forget":
+		if flag.NArg() != 2 {
+			fmt.Fprintln(os.Stderr, "Error: forget command requires a directory path")
+			flag.Usage()
+			os.Exit(1)
+		}
+		dirPath := flag.Arg(1)
+		exitIfDaemon(*socketPath, *indexName)
+		lockCache(c)
+		loadCache(idx, c, false)
+		handleForget(dirPath, idx, c)
 
 	default:
 		fmt.Fprintf(os.Stderr, "Error: unknown command %q\n", command)
@@ -83,61 +319,460 @@ func main() {
 	}
 }
 
-func handleIndex(dirPath string, idx *indexer.Index, cache *cache.Cache) {
-	fmt.Printf("Indexing directory: %s\n", dirPath)
+// lockCache takes the exclusive cache lock for the rest of the process,
+// exiting if another process holds it and --no-wait was given
+func lockCache(c *cache.Cache) {
+	if _, err := c.Lock(true); err != nil {
+		exitCacheError(err)
+		fmt.Fprintf(os.Stderr, "Error locking cache: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// exitCacheError exits with an explanation if err means the cache cannot be
+// used at all: another process holds its lock, or it is from a newer version
+// of indexer, which carrying on with an empty index would overwrite
+func exitCacheError(err error) {
+	var locked *cache.LockedError
+	switch {
+	case errors.As(err, &locked):
+		fmt.Fprintf(os.Stderr, "Error: %v; retry when it has finished or drop --no-wait to wait for it\n", err)
+		os.Exit(1)
+	case errors.Is(err, cache.ErrNewerVersion):
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// loadCache populates the index from the cache, optionally dropping
+// entries whose files no longer exist
+func loadCache(idx *indexer.Index, c *cache.Cache, pruneMissing bool) {
+	slog.Debug("loading cache")
+	data, err := c.Load()
+	if err != nil {
+		exitCacheError(err)
+		slog.Warn("could not load cache", "error", err)
+		return
+	}
+
+	for _, root := range data.Roots {
+		idx.AddRoot(root)
+	}
 
+	validFiles := 0
+	for path, entry := range data.Files {
+		if pruneMissing {
+			if _, err := os.Stat(path); err != nil {
+				continue
+			}
+		}
+		idx.AddEntry(entry)
+		validFiles++
+	}
+	slog.Debug("loaded cache", "files", validFiles)
+}
+
+func handleIndex(dirPath string, idx *indexer.Index, c *cache.Cache, progress *progressPrinter) {
 	absPath, err := filepath.Abs(dirPath)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error resolving path: %v\n", err)
 		os.Exit(1)
 	}
 
-	if err := idx.IndexDirectory(absPath); err != nil {
+	// An interrupted run leaves the index incomplete, so the previous cache
+	// is kept rather than saved over
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	idx.SetProgress(progress.interval(), progress.update)
+	if err := idx.IndexDirectoryContext(ctx, absPath); err != nil {
+		if ctx.Err() != nil {
+			fmt.Fprintln(os.Stderr, "Indexing interrupted; the cache was left unchanged")
+			os.Exit(1)
+		}
 		fmt.Fprintf(os.Stderr, "Error indexing directory: %v\n", err)
 		os.Exit(1)
 	}
 
-	// Save to cache
-	fmt.Println("Saving to cache...")
-	if err := cache.Save(idx); err != nil {
-		fmt.Fprintf(os.Stderr, "Warning: failed to save cache: %v\n", err)
+	printChanges(idx.Changes(), idx.FileCount())
+	saveCache(idx, c)
+}
+
+// saveCache saves the index, warning if it cannot
+func saveCache(idx *indexer.Index, c *cache.Cache) {
+	slog.Debug("saving cache")
+	if err := c.Save(idx); err != nil {
+		slog.Warn("failed to save cache", "error", err)
+	} else {
+		slog.Debug("cache saved")
+	}
+}
+
+// printChanges prints how indexing changed an index holding files files
+func printChanges(changes indexer.ChangeStats, files int) {
+	fmt.Printf("Indexing complete: %d added, %d updated, %d removed, %d unchanged\n",
+		changes.Added, changes.Updated, changes.Removed, changes.Unchanged)
+	fmt.Printf("Total files in index: %d\n", files)
+}
+
+// handleDaemonIndex asks a running daemon to index a directory
+func handleDaemonIndex(dirPath string, daemon *client.Client) {
+	slog.Debug("indexing directory through the daemon", "path", dirPath)
+
+	absPath, err := filepath.Abs(dirPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error resolving path: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Interrupting cancels the request, and with it the daemon's indexing
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	response, err := daemon.Reindex(ctx, absPath)
+	if err != nil {
+		if ctx.Err() != nil {
+			fmt.Fprintln(os.Stderr, "Indexing interrupted; the daemon kept its previous cache")
+			os.Exit(1)
+		}
+		fmt.Fprintf(os.Stderr, "Error indexing directory: %v\n", err)
+		os.Exit(1)
+	}
+	printChanges(response.Changes, response.Files)
+}
+
+// handleWatch indexes a directory and keeps the index live until interrupted
+func handleWatch(dirPath string, idx *indexer.Index, c *cache.Cache) {
+	absPath, err := filepath.Abs(dirPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error resolving path: %v\n", err)
+		os.Exit(1)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := watch.New(idx, c, absPath).Run(ctx); err != nil {
+		if errors.Is(err, context.Canceled) {
+			fmt.Fprintln(os.Stderr, "Indexing interrupted; the cache was left unchanged")
+			os.Exit(1)
+		}
+		fmt.Fprintf(os.Stderr, "Error watching directory: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// handleServe serves the loaded index over HTTP until the process is stopped
+func handleServe(addr string, allowNewRoots bool, idx *indexer.Index, c *cache.Cache) {
+	slog.Info("serving", "files", idx.FileCount(), "addr", addr)
+	srv := server.New(idx, c)
+	srv.AllowNewRoots = allowNewRoots
+	srv.Addr = addr
+	if err := http.ListenAndServe(addr, srv); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// handleDaemon serves the loaded index on a Unix socket until interrupted
+func handleDaemon(socketPath string, idx *indexer.Index, c *cache.Cache) {
+	// A socket left behind by a daemon that did not shut down cleanly would
+	// make listening fail; nothing is listening on it, as checked by the caller
+	if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+		fmt.Fprintf(os.Stderr, "Error removing stale socket: %v\n", err)
+		os.Exit(1)
+	}
+	if err := os.MkdirAll(filepath.Dir(socketPath), 0755); err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating socket directory: %v\n", err)
+		os.Exit(1)
+	}
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	// Only the owner may talk to the daemon
+	if err := os.Chmod(socketPath, 0600); err != nil {
+		listener.Close()
+		fmt.Fprintf(os.Stderr, "Error securing socket: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Indexing a directory through the daemon adds it as a root, as
+	// indexing it directly does
+	handler := server.New(idx, c)
+	handler.AllowNewRoots = true
+	srv := &http.Server{Handler: handler}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		// Closing the listener also removes the socket file
+		srv.Shutdown(context.Background())
+	}()
+
+	slog.Info("daemon serving", "files", idx.FileCount(), "socket", socketPath)
+	if err := srv.Serve(listener); err != nil && err != http.ErrServerClosed {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	slog.Info("daemon stopped")
+}
+
+// handleExplain prints whether a file would be indexed and why
+func handleExplain(path string, idx *indexer.Index) {
+	included, reason, err := idx.Explain(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if included {
+		fmt.Printf("%s: indexed (%s)\n", path, reason)
 	} else {
-		fmt.Println("Cache saved successfully")
+		fmt.Printf("%s: skipped (%s)\n", path, reason)
 	}
 }
 
-func handleSearch(keyword string, idx *indexer.Index) {
-	fmt.Printf("Searching for keyword: %s\n", keyword)
+// searchOptions holds the flags of the search command
+type searchOptions struct {
+	query.Options
+	before  int           // Context lines to print before each match
+	after   int           // Context lines to print after each match
+	format  format.Format // Output format of the results
+	timeout time.Duration // Time limit of the search, if positive
+}
+
+func handleSearch(keyword string, opts searchOptions, idx *indexer.Index, daemon *client.Client) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if opts.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.timeout)
+		defer cancel()
+	}
+
+	switch opts.Mode {
+	case query.RegexMode:
+		slog.Debug("searching for pattern", "pattern", keyword)
+	case query.QueryMode:
+		if node, err := query.Parse(keyword); err == nil {
+			slog.Debug("searching for query", "query", node.String())
+		}
+	default:
+		slog.Debug("searching for keyword", "keyword", keyword)
+	}
+
+	var results []search.SearchResult
+	var blocks []search.Block
+	withContext := opts.before > 0 || opts.after > 0
+	if daemon != nil {
+		response, err := daemon.Search(ctx, keyword, opts.Options, opts.before, opts.after)
+		if err != nil {
+			exitSearchError(err, opts.timeout)
+		}
+		results, blocks = response.Results, response.Blocks
+	} else {
+		var err error
+		results, err = query.RunContext(ctx, idx, keyword, opts.Options)
+		if err != nil {
+			exitSearchError(err, opts.timeout)
+		}
+		if withContext {
+			blocks = search.WithContext(idx, results, opts.before, opts.after)
+		}
+	}
 
-	results := search.Search(idx, keyword)
-	if len(results) == 0 {
+	if len(results) == 0 && opts.format == format.Text {
 		fmt.Println("No matches found.")
 		return
 	}
 
-	// Sort results by file path and line number
-	sort.Slice(results, func(i, j int) bool {
-		if results[i].FilePath == results[j].FilePath {
-			return results[i].LineNumber < results[j].LineNumber
+	if withContext {
+		if opts.format == format.Text {
+			printBlocks(blocks, opts)
+		} else {
+			writeRecords(format.FromBlocks(blocks), opts.format)
 		}
-		return results[i].FilePath < results[j].FilePath
-	})
+		return
+	}
 
-	fmt.Printf("\nFound matches in %d files:\n", len(results))
-	currentFile := ""
-	for _, result := range results {
-		// Print file header when we switch to a new file
-		if currentFile != result.FilePath {
-			currentFile = result.FilePath
-			relPath, err := filepath.Rel(".", currentFile)
-			if err != nil {
-				relPath = currentFile
-			}
-			fmt.Printf("\n%s:\n", relPath)
+	if opts.format == format.Text {
+		printResults(results, opts)
+	} else {
+		writeRecords(format.FromResults(results), opts.format)
+	}
+}
+
+// exitSearchError reports why a search failed and exits
+func exitSearchError(err error, timeout time.Duration) {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		fmt.Fprintf(os.Stderr, "Error: search timed out after %s\n", timeout)
+	case errors.Is(err, context.Canceled):
+		fmt.Fprintln(os.Stderr, "Search interrupted")
+	default:
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+	}
+	os.Exit(1)
+}
+
+func handleCacheConvert(compress bool, c *cache.Cache) {
+	result, err := c.Convert(compress)
+	exitCacheError(err)
+	if os.IsNotExist(err) {
+		fmt.Fprintln(os.Stderr, "Error: there is no cache to convert")
+		os.Exit(1)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error converting cache: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Converted %d files from %s (%.2f MB) to %s (%.2f MB)\n",
+		result.Files, result.From, float64(result.FromSize)/(1024*1024), result.To, float64(result.ToSize)/(1024*1024))
+}
+
+func handleCacheInfo(c *cache.Cache) {
+	header, err := c.Info()
+	if os.IsNotExist(err) {
+		fmt.Println("There is no cache yet.")
+		return
+	}
+	exitCacheError(err)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading cache: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Format version: %d\n", header.FormatVersion)
+	if header.ToolVersion != "" {
+		fmt.Printf("Written by:     indexer %s\n", header.ToolVersion)
+	}
+	if !header.Created.IsZero() {
+		fmt.Printf("Created:        %s\n", header.Created.Local().Format("2006-01-02 15:04:05"))
+	}
+	fmt.Printf("Roots:          %d\n", len(header.Roots))
+	for _, root := range header.Roots {
+		fmt.Printf("  %s (%d files)\n", root.Path, root.Files)
+	}
+}
+
+// handleRoots lists the roots of the index, or of the daemon's copy of it
+// when one is serving it
+func handleRoots(idx *indexer.Index, daemon *client.Client) {
+	roots := idx.Roots()
+	if daemon != nil {
+		stats, err := daemon.Stats()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
 		}
+		roots = stats.Roots
+	}
+	if len(roots) == 0 {
+		fmt.Println("No directories indexed yet.")
+		return
+	}
 
-		// Print the matching line with line number
-		fmt.Printf("  %4d: %s\n", result.LineNumber, result.Line)
+	fmt.Printf("\nIndexed roots (%d):\n", len(roots))
+	for _, root := range roots {
+		fmt.Printf("  %s\n", root.Path)
+		fmt.Printf("    files: %d, last indexed: %s\n", root.Files, root.IndexedAt.Local().Format("2006-01-02 15:04:05"))
 	}
 	fmt.Println()
 }
+
+func handleForget(dirPath string, idx *indexer.Index, c *cache.Cache) {
+	absPath, err := filepath.Abs(dirPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error resolving path: %v\n", err)
+		os.Exit(1)
+	}
+
+	removed, ok := idx.Forget(absPath)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Error: %s is not an indexed root\n", absPath)
+		os.Exit(1)
+	}
+	fmt.Printf("Forgot %s (%d files removed)\n", absPath, removed)
+	saveCache(idx, c)
+}
+
+func handleIndexes(args []string, indexes *cache.Indexes) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "Error: indexes command requires the list, delete or rename subcommand")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	switch args[0] {
+	case "list":
+		summaries, err := indexes.List()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error listing indexes: %v\n", err)
+			os.Exit(1)
+		}
+		if len(summaries) == 0 {
+			fmt.Println("No indexes saved yet.")
+			return
+		}
+
+		fmt.Printf("\nIndexes (%d):\n", len(summaries))
+		for _, s := range summaries {
+			fmt.Printf("  %s\n", s.Name)
+			fmt.Printf("    %s (%.2f MB), saved: %s\n", s.Path, float64(s.Size)/(1024*1024), s.Modified.Local().Format("2006-01-02 15:04:05"))
+		}
+		fmt.Println()
+
+	case "delete":
+		if len(args) != 2 {
+			fmt.Fprintln(os.Stderr, "Error: indexes delete requires an index name")
+			flag.Usage()
+			os.Exit(1)
+		}
+		exitIfServed(args[1], indexes)
+		err := indexes.Delete(args[1])
+		exitCacheError(err)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Deleted index %s\n", args[1])
+
+	case "rename":
+		if len(args) != 3 {
+			fmt.Fprintln(os.Stderr, "Error: indexes rename requires the old and new index names")
+			flag.Usage()
+			os.Exit(1)
+		}
+		exitIfServed(args[1], indexes)
+		err := indexes.Rename(args[1], args[2])
+		exitCacheError(err)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Renamed index %s to %s\n", args[1], args[2])
+
+	default:
+		fmt.Fprintf(os.Stderr, "Error: unknown indexes subcommand %q\n", args[0])
+		flag.Usage()
+		os.Exit(1)
+	}
+}
+
+// exitIfDaemon exits if a daemon is listening on socket, since it would save
+// its copy of the named index over changes made to the cache
+func exitIfDaemon(socket, name string) {
+	if client.New(socket).Available() {
+		fmt.Fprintf(os.Stderr, "Error: a daemon is serving index %s; stop it first\n", name)
+		os.Exit(1)
+	}
+}
+
+// exitIfServed exits if a daemon is serving the named index from its default
+// socket, since it would go on saving the index under its old name
+func exitIfServed(name string, indexes *cache.Indexes) {
+	if cache.ValidateName(name) != nil {
+		return
+	}
+	exitIfDaemon(filepath.Join(indexes.Dir(name), socketName), name)
+}
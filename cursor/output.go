@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"indexer/pkg/format"
+	"indexer/pkg/query"
+	"indexer/pkg/search"
+)
+
+// printResults prints matching lines grouped by file
+func printResults(results []search.SearchResult, opts searchOptions) {
+	fmt.Printf("\nFound matches in %d files:\n", len(results))
+	currentFile := ""
+	for _, result := range results {
+		// Print file header when we switch to a new file
+		if currentFile != result.FilePath {
+			currentFile = result.FilePath
+			printFileHeader(result.FilePath, result.Score, opts)
+		}
+
+		// Files matched only by qualifiers or negations have no lines
+		if result.LineNumber == 0 {
+			continue
+		}
+
+		// Print the matching line with line number, plus the column
+		// spans of each match when searching by pattern
+		if opts.Mode == query.RegexMode {
+			fmt.Printf("  %4d [%s]: %s\n", result.LineNumber, formatSpans(result.Matches), result.Line)
+		} else {
+			fmt.Printf("  %4d: %s\n", result.LineNumber, result.Line)
+		}
+	}
+	fmt.Println()
+}
+
+// printBlocks prints matches with their context lines grouped by file.
+// Matching lines use ':' after the line number and context lines use '-',
+// and non-adjacent blocks of the same file are separated by "--".
+func printBlocks(blocks []search.Block, opts searchOptions) {
+	fmt.Printf("\nFound matches in %d blocks:\n", len(blocks))
+	currentFile := ""
+	for _, block := range blocks {
+		if currentFile != block.FilePath {
+			currentFile = block.FilePath
+			printFileHeader(block.FilePath, block.Score, opts)
+		} else {
+			fmt.Println("    --")
+		}
+
+		for _, line := range block.Lines {
+			switch {
+			case !line.Match:
+				fmt.Printf("  %4d- %s\n", line.LineNumber, line.Line)
+			case opts.Mode == query.RegexMode:
+				fmt.Printf("  %4d [%s]: %s\n", line.LineNumber, formatSpans(line.Matches), line.Line)
+			default:
+				fmt.Printf("  %4d: %s\n", line.LineNumber, line.Line)
+			}
+		}
+	}
+	fmt.Println()
+}
+
+// printFileHeader prints the path of a file relative to the working
+// directory, with its score when results are ranked
+func printFileHeader(path string, score float64, opts searchOptions) {
+	relPath, err := filepath.Rel(".", path)
+	if err != nil {
+		relPath = path
+	}
+	if opts.Rank {
+		fmt.Printf("\n%s (score %.3f):\n", relPath, score)
+	} else {
+		fmt.Printf("\n%s:\n", relPath)
+	}
+}
+
+// writeRecords writes search records to stdout in a machine-readable format
+func writeRecords(records []format.Record, f format.Format) {
+	if err := format.Write(os.Stdout, f, records); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing results: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// formatSpans renders match column spans as "start-end" pairs
+func formatSpans(matches []search.Match) string {
+	spans := make([]string, len(matches))
+	for i, m := range matches {
+		spans[i] = fmt.Sprintf("%d-%d", m.Column, m.EndColumn)
+	}
+	return strings.Join(spans, ", ")
+}
@@ -1,63 +1,624 @@
 package cache
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/gob"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
 	"indexer/pkg/indexer"
+	"indexer/pkg/version"
 )
 
-const defaultCacheFile = ".indexer_cache.json"
+const (
+	defaultCacheFile = ".indexer_cache.bin"
+	legacyCacheFile  = ".indexer_cache.json" // Indented JSON written by earlier versions
+	previousSuffix   = ".prev"               // Suffix of the previous generation of the cache file
+)
+
+// File header: magic, format version, flags and the CRC-32 checksum of the
+// body as stored. The body is a gob-encoded Header followed by the files,
+// stored as their content and postings so that loading does not tokenize
+// them again.
+var magic = []byte("IDXC")
+
+const (
+	formatVersion = 1
+	headerSize    = 6
+	checksumSize  = 4
+	flagGzip      = 1 << 0 // The body is gzip-compressed
+)
+
+// ErrNewerVersion is returned when the cache was written in a format newer
+// than this version of indexer reads
+var ErrNewerVersion = errors.New("cache is from a newer version of indexer")
 
-// Cache handles persistent storage of indexed data
+// Cache handles persistent storage of indexed data. Saves replace the cache
+// file atomically and keep the replaced file as the previous generation, which
+// Load falls back to if the current file is missing or damaged.
 type Cache struct {
-	filePath string
+	filePath   string
+	legacyPath string
+	mu         sync.Mutex // Guards held
+	held       *Lock      // Lock taken with Lock, if any
+
+	// Wait makes operations wait for a lock held by another process instead
+	// of failing with a *LockedError
+	Wait bool
+}
+
+// Header describes a cache file. JSON caches only have roots, and format
+// version 0.
+type Header struct {
+	FormatVersion int
+	ToolVersion   string    // Version of indexer that wrote the cache
+	Created       time.Time // When the cache was written
+	Roots         []indexer.Root
+}
+
+// Data is the persisted form of an index
+type Data struct {
+	Roots []indexer.Root
+	Files map[string]*indexer.FileEntry
+}
+
+// payload is the body of the binary format, following the Header
+type payload struct {
+	Files []fileRecord
+	Terms []string // Dictionary of the terms in Postings
+}
+
+// fileRecord is the binary form of a FileEntry
+type fileRecord struct {
+	Path     string
+	Content  string
+	Modified int64
+	Size     int64
+	Postings []byte // Encoded by encodePostings
+}
+
+// legacyEntry is a file in the JSON cache written by earlier versions, a
+// map of paths to entries with their lines keyed by their number
+type legacyEntry struct {
+	Path      string         `json:"path"`
+	LineIndex map[int]string `json:"line_index"`
+	Modified  int64          `json:"modified"`
+}
+
+// ConvertResult describes what Convert rewrote
+type ConvertResult struct {
+	From     string // The file the cache was read from
+	FromSize int64
+	To       string // The file the cache was written to
+	ToSize   int64
+	Files    int
 }
 
 // NewCache creates a new cache instance
 func NewCache(cacheDir string) *Cache {
 	return &Cache{
-		filePath: filepath.Join(cacheDir, defaultCacheFile),
+		filePath:   filepath.Join(cacheDir, defaultCacheFile),
+		legacyPath: filepath.Join(cacheDir, legacyCacheFile),
+		Wait:       true,
 	}
 }
 
-// Save persists the index data to disk
+// Save persists the index data to disk, keeping the compression setting of
+// the existing cache file. It holds an exclusive lock while writing.
 func (c *Cache) Save(idx *indexer.Index) error {
-	data := idx.GetFiles()
-
-	// Create cache directory if it doesn't exist
-	if err := os.MkdirAll(filepath.Dir(c.filePath), 0755); err != nil {
+	release, err := c.acquire(true)
+	if err != nil {
 		return err
 	}
+	defer release()
+
+	data := &Data{
+		Roots: idx.Roots(),
+		Files: idx.GetFiles(),
+	}
+	return c.write(data, c.compressed())
+}
 
-	// Marshal data to JSON
-	jsonData, err := json.MarshalIndent(data, "", "  ")
+// SaveRoot saves root and the files of the index beneath it into the cache,
+// keeping the other roots and files as they are on disk. It holds an
+// exclusive lock from reading the cache to writing it, so that changes other
+// processes saved since the index was loaded are not overwritten.
+func (c *Cache) SaveRoot(idx *indexer.Index, root string) error {
+	release, err := c.acquire(true)
 	if err != nil {
 		return err
 	}
+	defer release()
 
-	// Write to file
-	return os.WriteFile(c.filePath, jsonData, 0644)
+	_, saved, err := c.loadLocked()
+	if err != nil {
+		return err
+	}
+	data := &Data{Files: make(map[string]*indexer.FileEntry, len(saved.Files))}
+	for _, r := range saved.Roots {
+		if r.Path != root {
+			data.Roots = append(data.Roots, r)
+		}
+	}
+	for path, entry := range saved.Files {
+		if !within(path, root) {
+			data.Files[path] = entry
+		}
+	}
+	for _, r := range idx.Roots() {
+		if r.Path == root {
+			data.Roots = append(data.Roots, r)
+		}
+	}
+	for path, entry := range idx.GetFiles() {
+		if within(path, root) {
+			data.Files[path] = entry
+		}
+	}
+	return c.write(data, c.compressed())
 }
 
-// Load reads the index data from disk
-func (c *Cache) Load() (map[string]*indexer.FileEntry, error) {
-	data := make(map[string]*indexer.FileEntry)
+// Load reads the index data from disk, migrating the JSON cache of earlier
+// versions. A cache in a newer format is an error matching ErrNewerVersion.
+// It holds a shared lock while reading.
+func (c *Cache) Load() (*Data, error) {
+	release, err := c.acquire(false)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	_, data, err := c.loadLocked()
+	return data, err
+}
 
-	// Read file
-	jsonData, err := os.ReadFile(c.filePath)
+// Info returns the header of the cache Load would read, or an error matching
+// os.ErrNotExist if there is no cache
+func (c *Cache) Info() (*Header, error) {
+	release, err := c.acquire(false)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return data, nil
+		return nil, err
+	}
+	defer release()
+
+	header, _, err := c.loadLocked()
+	if err == nil && header == nil {
+		err = os.ErrNotExist
+	}
+	return header, err
+}
+
+// loadLocked reads the cache, falling back to the previous generation and
+// then to the JSON cache. The header is nil if there is no cache.
+func (c *Cache) loadLocked() (*Header, *Data, error) {
+	header, data, err := c.read(c.filePath)
+	if err != nil && !errors.Is(err, ErrNewerVersion) {
+		// The previous generation of a newer cache is not used, since saving
+		// over it would lose the newer one
+		prevHeader, previous, prevErr := c.read(c.filePath + previousSuffix)
+		if prevErr == nil {
+			if !os.IsNotExist(err) {
+				slog.Warn("using the previous cache generation", "error", err)
+			}
+			header, data, err = prevHeader, previous, nil
 		}
+	}
+	if os.IsNotExist(err) {
+		header, data, err = c.readLegacy()
+	}
+	if os.IsNotExist(err) {
+		return nil, &Data{Files: make(map[string]*indexer.FileEntry)}, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if data.Files == nil {
+		data.Files = make(map[string]*indexer.FileEntry)
+	}
+	return header, data, nil
+}
+
+// Convert rewrites the cache in the binary format, gzip-compressed or not.
+// A JSON cache from an earlier version is removed once it has been converted,
+// unless the converted cache is missing any of its files.
+func (c *Cache) Convert(compress bool) (*ConvertResult, error) {
+	// Report the file Load reads from
+	from, info := c.existing()
+	if info == nil {
+		return nil, os.ErrNotExist
+	}
+	result := &ConvertResult{From: from, FromSize: info.Size(), To: c.filePath}
+
+	release, err := c.acquire(true)
+	if err != nil {
 		return nil, err
 	}
+	defer release()
 
-	// Unmarshal JSON
-	if err := json.Unmarshal(jsonData, &data); err != nil {
+	_, data, err := c.loadLocked()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.write(data, compress); err != nil {
 		return nil, err
 	}
+	result.Files = len(data.Files)
+
+	if info, err := os.Stat(c.filePath); err == nil {
+		result.ToSize = info.Size()
+	}
+	if result.From == c.legacyPath {
+		if err := c.verifyConverted(); err != nil {
+			return nil, err
+		}
+		if err := os.Remove(c.legacyPath); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// verifyConverted checks that the cache file written from the JSON cache
+// holds every file of it, so that the JSON cache can be removed
+func (c *Cache) verifyConverted() error {
+	legacy, err := c.loadLegacy()
+	if err != nil {
+		return err
+	}
+	_, data, err := c.read(c.filePath)
+	if err != nil {
+		return err
+	}
+	if len(legacy) == 0 {
+		return fmt.Errorf("%s has no files, so it was kept", c.legacyPath)
+	}
+	if len(data.Files) != len(legacy) {
+		return fmt.Errorf("only %d of the %d files in %s were converted, so it was kept",
+			len(data.Files), len(legacy), c.legacyPath)
+	}
+	return nil
+}
+
+// write encodes data to a temporary file next to the cache file, flushes it
+// to disk and renames it over the cache file, keeping the file it replaces as
+// the previous generation unless it is damaged
+func (c *Cache) write(data *Data, compress bool) error {
+	// Create cache directory if it doesn't exist
+	dir := filepath.Dir(c.filePath)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	file, err := os.CreateTemp(dir, defaultCacheFile+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmpPath := file.Name()
+	defer func() {
+		// Only reached with the file still in place if writing failed
+		file.Close()
+		os.Remove(tmpPath)
+	}()
+
+	// CreateTemp makes the file private, but the cache has always been world-readable
+	if err := file.Chmod(0644); err != nil {
+		return err
+	}
+	if err := encode(file, data, compress); err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	// A damaged cache file is replaced without becoming the previous
+	// generation, which may be the only usable one
+	if err := verify(c.filePath); err == nil {
+		if err := os.Rename(c.filePath, c.filePath+previousSuffix); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		slog.Warn("replacing the damaged cache file", "error", err)
+	}
+	if err := os.Rename(tmpPath, c.filePath); err != nil {
+		return err
+	}
+	syncDir(dir)
+	return nil
+}
+
+// encode writes the header and body of the binary format to file
+func encode(file *os.File, data *Data, compress bool) error {
+	header := make([]byte, headerSize+checksumSize)
+	copy(header, magic)
+	header[4] = formatVersion
+	if compress {
+		header[5] |= flagGzip
+	}
+	if _, err := file.Write(header); err != nil {
+		return err
+	}
+
+	// Checksum the body as it is written, then fill it into the header
+	checksum := crc32.NewIEEE()
+	buffered := bufio.NewWriter(io.MultiWriter(file, checksum))
+	var body io.Writer = buffered
+	var zw *gzip.Writer
+	if compress {
+		zw = gzip.NewWriter(buffered)
+		body = zw
+	}
+	encoder := gob.NewEncoder(body)
+	if err := encoder.Encode(&Header{
+		FormatVersion: formatVersion,
+		ToolVersion:   version.Version,
+		Created:       time.Now(),
+		Roots:         data.Roots,
+	}); err != nil {
+		return err
+	}
+	if err := encoder.Encode(toPayload(data)); err != nil {
+		return err
+	}
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			return err
+		}
+	}
+	if err := buffered.Flush(); err != nil {
+		return err
+	}
+
+	binary.BigEndian.PutUint32(header[headerSize:], checksum.Sum32())
+	_, err := file.WriteAt(header[headerSize:], headerSize)
+	return err
+}
+
+// verify checks that path is a cache file whose body matches its checksum,
+// without decoding it. Files in a newer format are taken to be intact.
+func verify(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
 
+	buffered := bufio.NewReader(file)
+	prefix := make([]byte, headerSize+checksumSize)
+	if _, err := io.ReadFull(buffered, prefix); err != nil || !bytes.Equal(prefix[:4], magic) {
+		return fmt.Errorf("%s is not an indexer cache", path)
+	}
+	if prefix[4] > formatVersion {
+		return nil
+	}
+	if prefix[4] < formatVersion {
+		return fmt.Errorf("%s has unknown format version %d", path, prefix[4])
+	}
+	checksum := crc32.NewIEEE()
+	if _, err := io.Copy(checksum, buffered); err != nil {
+		return err
+	}
+	if checksum.Sum32() != binary.BigEndian.Uint32(prefix[headerSize:]) {
+		return fmt.Errorf("%s is damaged: checksum mismatch", path)
+	}
+	return nil
+}
+
+// syncDir flushes a directory so that renames within it survive a crash.
+// Not every platform supports this, so failures are ignored.
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
+
+// read decodes a binary cache file, verifying its checksum
+func (c *Cache) read(path string) (*Header, *Data, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	buffered := bufio.NewReader(file)
+	prefix := make([]byte, headerSize)
+	if _, err := io.ReadFull(buffered, prefix); err != nil || !bytes.Equal(prefix[:4], magic) {
+		return nil, nil, fmt.Errorf("%s is not an indexer cache", path)
+	}
+	fileVersion := int(prefix[4])
+	if fileVersion > formatVersion {
+		return nil, nil, fmt.Errorf("%w: %s has format version %d, but indexer %s only reads up to %d",
+			ErrNewerVersion, path, fileVersion, version.Version, formatVersion)
+	}
+	if fileVersion < formatVersion {
+		return nil, nil, fmt.Errorf("%s has unknown format version %d", path, fileVersion)
+	}
+
+	stored := make([]byte, checksumSize)
+	if _, err := io.ReadFull(buffered, stored); err != nil {
+		return nil, nil, fmt.Errorf("%s is truncated", path)
+	}
+	checksum := crc32.NewIEEE()
+	raw := io.TeeReader(buffered, checksum)
+
+	var body io.Reader = raw
+	if prefix[5]&flagGzip != 0 {
+		zr, err := gzip.NewReader(raw)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to decompress %s: %w", path, err)
+		}
+		defer zr.Close()
+		body = zr
+	}
+
+	decoder := gob.NewDecoder(body)
+	header := &Header{}
+	if err := decoder.Decode(header); err != nil {
+		return nil, nil, fmt.Errorf("failed to decode %s: %w", path, err)
+	}
+	var p payload
+	if err := decoder.Decode(&p); err != nil {
+		return nil, nil, fmt.Errorf("failed to decode %s: %w", path, err)
+	}
+	// Include anything the decoder did not need, such as trailing garbage
+	if _, err := io.Copy(io.Discard, raw); err != nil {
+		return nil, nil, err
+	}
+	if checksum.Sum32() != binary.BigEndian.Uint32(stored) {
+		return nil, nil, fmt.Errorf("%s is damaged: checksum mismatch", path)
+	}
+
+	header.FormatVersion = fileVersion
+	data, err := fromPayload(header.Roots, &p)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to decode %s: %w", path, err)
+	}
+	return header, data, nil
+}
+
+// toPayload converts data to the binary form
+func toPayload(data *Data) *payload {
+	p := &payload{
+		Files: make([]fileRecord, 0, len(data.Files)),
+	}
+	dict := newDictionary()
+	for path, entry := range data.Files {
+		p.Files = append(p.Files, fileRecord{
+			Path:     path,
+			Content:  entry.Content(),
+			Modified: entry.Modified,
+			Size:     entry.Size,
+			Postings: dict.encodePostings(nil, entry.Postings()),
+		})
+	}
+	p.Terms = dict.terms
+	return p
+}
+
+// fromPayload converts the binary form back to data
+func fromPayload(roots []indexer.Root, p *payload) (*Data, error) {
+	data := &Data{
+		Roots: roots,
+		Files: make(map[string]*indexer.FileEntry, len(p.Files)),
+	}
+	for _, record := range p.Files {
+		postings, err := decodePostings(record.Path, record.Postings, p.Terms)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", record.Path, err)
+		}
+		data.Files[record.Path] = indexer.NewFileEntryWithPostings(record.Path, record.Content, record.Modified, record.Size, postings)
+	}
 	return data, nil
 }
+
+// readLegacy decodes a JSON cache written by an earlier version. Those
+// recorded no roots, so its files are put under a single one: the directory
+// containing them all, as if that had been indexed when the cache was
+// written. A cache with entries none of which can be read is an error rather
+// than an empty index, which would be saved over it.
+func (c *Cache) readLegacy() (*Header, *Data, error) {
+	legacy, err := c.loadLegacy()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	data := &Data{Files: make(map[string]*indexer.FileEntry, len(legacy))}
+	for path, entry := range legacy {
+		if entry == nil || entry.Path == "" {
+			continue
+		}
+		lines := make([]string, len(entry.LineIndex))
+		for lineNum, line := range entry.LineIndex {
+			if lineNum >= 1 && lineNum <= len(lines) {
+				lines[lineNum-1] = line
+			}
+		}
+		data.Files[path] = indexer.NewFileEntryFromLines(entry.Path, lines, entry.Modified, 0)
+	}
+	if len(data.Files) == 0 && len(legacy) > 0 {
+		return nil, nil, fmt.Errorf("failed to decode %s: none of its %d files could be read", c.legacyPath, len(legacy))
+	}
+	if len(data.Files) > 0 {
+		var indexedAt time.Time
+		if info, err := os.Stat(c.legacyPath); err == nil {
+			indexedAt = info.ModTime()
+		}
+		data.Roots = []indexer.Root{{
+			Path:      commonDir(data.Files),
+			Files:     len(data.Files),
+			IndexedAt: indexedAt,
+		}}
+	}
+	return &Header{Roots: data.Roots}, data, nil
+}
+
+// loadLegacy reads and decodes the JSON cache
+func (c *Cache) loadLegacy() (map[string]*legacyEntry, error) {
+	jsonData, err := os.ReadFile(c.legacyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var legacy map[string]*legacyEntry
+	if err := json.Unmarshal(jsonData, &legacy); err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %w", c.legacyPath, err)
+	}
+	return legacy, nil
+}
+
+// commonDir returns the deepest directory containing every file
+func commonDir(files map[string]*indexer.FileEntry) string {
+	dir := ""
+	for path := range files {
+		if dir == "" {
+			dir = filepath.Dir(path)
+		}
+		for !within(path, dir) {
+			parent := filepath.Dir(dir)
+			if parent == dir {
+				break
+			}
+			dir = parent
+		}
+	}
+	return dir
+}
+
+// within reports whether path lies beneath dir
+func within(path, dir string) bool {
+	if !strings.HasSuffix(dir, string(os.PathSeparator)) {
+		dir += string(os.PathSeparator)
+	}
+	return strings.HasPrefix(path, dir)
+}
+
+// compressed reports whether the existing cache file is gzip-compressed
+func (c *Cache) compressed() bool {
+	file, err := os.Open(c.filePath)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(file, header); err != nil || !bytes.Equal(header[:4], magic) {
+		return false
+	}
+	return header[5]&flagGzip != 0
+}
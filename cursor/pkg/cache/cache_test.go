@@ -0,0 +1,386 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"indexer/pkg/indexer"
+)
+
+// testFiles is the content of the files in the test caches
+var testFiles = map[string]string{
+	"/src/a.go":     "package main\n\nfunc main() {}\n",
+	"/src/b.txt":    "hello world\r\nsecond line",
+	"/src/sub/c.md": "",
+}
+
+// migratedFiles is testFiles as migrated from the formats storing lines,
+// which did not record whether a file ended with a newline
+var migratedFiles = map[string]string{
+	"/src/a.go":     "package main\n\nfunc main() {}",
+	"/src/b.txt":    "hello world\r\nsecond line",
+	"/src/sub/c.md": "",
+}
+
+// testRoots are the roots of the test caches
+var testRoots = []indexer.Root{{Path: "/src", Files: 3, IndexedAt: time.Unix(1700000000, 0).UTC()}}
+
+// testIndex builds an index holding testFiles and testRoots
+func testIndex() *indexer.Index {
+	idx := indexer.NewIndex(1)
+	for _, root := range testRoots {
+		idx.AddRoot(root)
+	}
+	for path, content := range testFiles {
+		idx.AddEntry(indexer.NewFileEntry(path, content, 1, int64(len(content))))
+	}
+	return idx
+}
+
+// linesOf splits content into lines the way the versions storing lines did,
+// without an empty line after a final newline
+func linesOf(content string) []string {
+	if content == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(content, "\n"), "\n")
+}
+
+// checkData fails the test unless data holds files, with their postings, and
+// the given roots
+func checkData(t *testing.T, data *Data, files map[string]string, roots []indexer.Root) {
+	t.Helper()
+	if len(data.Files) != len(files) {
+		t.Fatalf("loaded %d files, want %d", len(data.Files), len(files))
+	}
+	for path, content := range files {
+		entry, ok := data.Files[path]
+		if !ok {
+			t.Fatalf("%s is missing", path)
+		}
+		if entry.Content() != content {
+			t.Errorf("%s has content %q, want %q", path, entry.Content(), content)
+		}
+		want := indexer.NewFileEntry(path, content, 0, 0).Postings()
+		if !reflect.DeepEqual(entry.Postings(), want) {
+			t.Errorf("%s has postings %v, want %v", path, entry.Postings(), want)
+		}
+	}
+	if !reflect.DeepEqual(data.Roots, roots) {
+		t.Errorf("loaded roots %v, want %v", data.Roots, roots)
+	}
+}
+
+func TestSaveLoad(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		t.Run(fmt.Sprintf("gzip=%v", compress), func(t *testing.T) {
+			c := NewCache(t.TempDir())
+			if err := c.write(&Data{Roots: testRoots, Files: testIndex().GetFiles()}, compress); err != nil {
+				t.Fatal(err)
+			}
+			if got := c.compressed(); got != compress {
+				t.Errorf("compressed() = %v, want %v", got, compress)
+			}
+
+			data, err := c.Load()
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkData(t, data, testFiles, testRoots)
+
+			header, err := c.Info()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if header.FormatVersion != formatVersion {
+				t.Errorf("format version %d, want %d", header.FormatVersion, formatVersion)
+			}
+		})
+	}
+}
+
+func TestLoadMissing(t *testing.T) {
+	c := NewCache(t.TempDir())
+	data, err := c.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data.Files) != 0 || len(data.Roots) != 0 {
+		t.Errorf("loaded %d files and %d roots from no cache", len(data.Files), len(data.Roots))
+	}
+	if _, err := c.Info(); !os.IsNotExist(err) {
+		t.Errorf("Info() error = %v, want a not-exist error", err)
+	}
+}
+
+func TestLoadFallsBackToPrevious(t *testing.T) {
+	tests := []struct {
+		name   string
+		damage func(content []byte) []byte // Returns the damaged content, or nil to remove the file
+	}{
+		{"flipped body byte", func(b []byte) []byte { b[len(b)-10] ^= 0xff; return b }},
+		{"flipped checksum", func(b []byte) []byte { b[headerSize] ^= 0xff; return b }},
+		{"truncated", func(b []byte) []byte { return b[:len(b)/2] }},
+		{"trailing garbage", func(b []byte) []byte { return append(b, "garbage"...) }},
+		{"bad magic", func(b []byte) []byte { return append([]byte("JUNK"), b[4:]...) }},
+		{"empty", func(b []byte) []byte { return []byte{} }},
+		{"missing", func(b []byte) []byte { return nil }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewCache(t.TempDir())
+			// The first save becomes the previous generation of the second
+			if err := c.Save(testIndex()); err != nil {
+				t.Fatal(err)
+			}
+			newer := testIndex()
+			newer.AddEntry(indexer.NewFileEntry("/src/new.go", "package new\n", 2, 12))
+			if err := c.Save(newer); err != nil {
+				t.Fatal(err)
+			}
+
+			content, err := os.ReadFile(c.filePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if damaged := tt.damage(content); damaged != nil {
+				err = os.WriteFile(c.filePath, damaged, 0644)
+			} else {
+				err = os.Remove(c.filePath)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			data, err := c.Load()
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkData(t, data, testFiles, testRoots)
+
+			// Saving replaces the damaged file and keeps the previous generation
+			if err := c.Save(newer); err != nil {
+				t.Fatal(err)
+			}
+			_, previous, err := c.read(c.filePath + previousSuffix)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkData(t, previous, testFiles, testRoots)
+		})
+	}
+}
+
+func TestLoadDamagedWithoutPrevious(t *testing.T) {
+	c := NewCache(t.TempDir())
+	if err := c.Save(testIndex()); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(c.filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Damage a file's content, which still decodes
+	content[bytes.Index(content, []byte("hello world"))] ^= 0x20
+	if err := os.WriteFile(c.filePath, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.Load(); err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Errorf("Load() error = %v, want a checksum mismatch", err)
+	}
+}
+
+// legacyFiles encodes testFiles as the files of a JSON cache
+func legacyFiles(t *testing.T) string {
+	t.Helper()
+	files := make(map[string]*legacyEntry, len(testFiles))
+	for path, content := range testFiles {
+		entry := &legacyEntry{Path: path, LineIndex: make(map[int]string), Modified: 1}
+		for i, line := range linesOf(content) {
+			entry.LineIndex[i+1] = line
+		}
+		files[path] = entry
+	}
+	encoded, err := json.Marshal(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(encoded)
+}
+
+func TestMigrateJSON(t *testing.T) {
+	files := legacyFiles(t)
+	tests := []struct {
+		name    string
+		json    string
+		roots   func(modified time.Time) []indexer.Root
+		wantErr string
+	}{
+		{
+			// The first JSON caches are covered by the directory holding their files
+			name: "without roots",
+			json: files,
+			roots: func(modified time.Time) []indexer.Root {
+				return []indexer.Root{{Path: "/src", Files: len(testFiles), IndexedAt: modified}}
+			},
+		},
+		{
+			name:    "unreadable entries",
+			json:    `{"/src/a.go":{"bogus":1},"/src/b.go":null}`,
+			wantErr: "none of its 2 files could be read",
+		},
+		{
+			name:    "not an object",
+			json:    `[1,2,3]`,
+			wantErr: "failed to decode",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewCache(t.TempDir())
+			if err := os.WriteFile(c.legacyPath, []byte(tt.json), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			data, err := c.Load()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Load() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			info, err := os.Stat(c.legacyPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkData(t, data, migratedFiles, tt.roots(info.ModTime()))
+			if header, err := c.Info(); err != nil || header.FormatVersion != 0 {
+				t.Errorf("Info() = %+v, %v, want format version 0", header, err)
+			}
+		})
+	}
+}
+
+func TestConvertJSON(t *testing.T) {
+	tests := []struct {
+		name      string
+		json      string
+		wantErr   string
+		wantFiles int
+	}{
+		{
+			name:      "every file converted",
+			json:      `{"/src/a.go":{"path":"/src/a.go","line_index":{"1":"package a"},"modified":1}}`,
+			wantFiles: 1,
+		},
+		{
+			name:    "some files unreadable",
+			json:    `{"/src/a.go":{"path":"/src/a.go","line_index":{"1":"package a"},"modified":1},"/src/b.go":null}`,
+			wantErr: "only 1 of the 2 files",
+		},
+		{
+			name:    "no files",
+			json:    `{}`,
+			wantErr: "has no files",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewCache(t.TempDir())
+			if err := os.WriteFile(c.legacyPath, []byte(tt.json), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			result, err := c.Convert(false)
+			_, statErr := os.Stat(c.legacyPath)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("Convert() error = %v, want %q", err, tt.wantErr)
+				}
+				if statErr != nil {
+					t.Errorf("the JSON cache was removed: %v", statErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Files != tt.wantFiles {
+				t.Errorf("converted %d files, want %d", result.Files, tt.wantFiles)
+			}
+			if !os.IsNotExist(statErr) {
+				t.Errorf("the JSON cache was kept: %v", statErr)
+			}
+		})
+	}
+}
+
+func TestNewerVersion(t *testing.T) {
+	c := NewCache(t.TempDir())
+	if err := c.Save(testIndex()); err != nil {
+		t.Fatal(err)
+	}
+	// A valid previous generation must not be used in place of a newer cache
+	if err := c.Save(testIndex()); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(c.filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content[4] = formatVersion + 1
+	if err := os.WriteFile(c.filePath, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.Load(); !errors.Is(err, ErrNewerVersion) {
+		t.Errorf("Load() error = %v, want ErrNewerVersion", err)
+	}
+	if _, err := c.Info(); !errors.Is(err, ErrNewerVersion) {
+		t.Errorf("Info() error = %v, want ErrNewerVersion", err)
+	}
+}
+
+func TestDecodePostingsRejectsDamage(t *testing.T) {
+	dict := newDictionary()
+	postings := indexer.NewFileEntry("/a", "foo bar\nfoo\n", 0, 0).Postings()
+	valid := dict.encodePostings(nil, postings)
+
+	if got, err := decodePostings("/a", valid, dict.terms); err != nil || !reflect.DeepEqual(got, postings) {
+		t.Fatalf("decodePostings() = %v, %v, want %v", got, err, postings)
+	}
+
+	tests := []struct {
+		name  string
+		buf   []byte
+		terms []string
+	}{
+		{"empty", nil, dict.terms},
+		{"truncated", valid[:len(valid)-1], dict.terms},
+		{"trailing bytes", append(append([]byte{}, valid...), 0), dict.terms},
+		{"unknown term", valid, dict.terms[:1]},
+		{"huge count", binary.AppendUvarint(nil, 1<<40), dict.terms},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := decodePostings("/a", tt.buf, tt.terms); !errors.Is(err, errBadPostings) {
+				t.Errorf("decodePostings() error = %v, want errBadPostings", err)
+			}
+		})
+	}
+}
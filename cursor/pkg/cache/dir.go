@@ -0,0 +1,66 @@
+package cache
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// DirEnv is the environment variable that sets the cache directory when no
+// directory is given explicitly
+const DirEnv = "INDEXER_CACHE_DIR"
+
+// ProjectDir is the name of a project-local cache directory. A directory
+// with this name in the working directory or one of its parents is used
+// like .git is found, so every checkout can keep its own indexes.
+const ProjectDir = ".indexer"
+
+// ResolveDir returns the cache directory to use, as an absolute path. It is
+// the first of:
+//
+//   - dir, when it is not empty
+//   - $INDEXER_CACHE_DIR
+//   - a .indexer directory in the working directory or one of its parents
+//   - $XDG_CACHE_HOME/indexer
+//   - ~/.cache/indexer
+func ResolveDir(dir string) (string, error) {
+	if dir != "" {
+		return filepath.Abs(dir)
+	}
+	if env := os.Getenv(DirEnv); env != "" {
+		return filepath.Abs(env)
+	}
+	if project, ok := findProjectDir(); ok {
+		return project, nil
+	}
+	// The XDG spec says relative paths are invalid and must be ignored
+	if xdg := os.Getenv("XDG_CACHE_HOME"); filepath.IsAbs(xdg) {
+		return filepath.Join(xdg, "indexer"), nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", errors.New("cannot find a cache directory: set --cache-dir or $" + DirEnv)
+	}
+	return filepath.Join(home, ".cache", "indexer"), nil
+}
+
+// findProjectDir looks for a project-local cache directory from the working
+// directory up to the filesystem root
+func findProjectDir() (string, bool) {
+	dir, err := os.Getwd()
+	if err != nil {
+		return "", false
+	}
+	for {
+		candidate := filepath.Join(dir, ProjectDir)
+		if info, err := os.Stat(candidate); err == nil && info.IsDir() {
+			return candidate, true
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", false
+		}
+		dir = parent
+	}
+}
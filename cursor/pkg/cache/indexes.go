@@ -0,0 +1,217 @@
+package cache
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+)
+
+// DefaultIndex is the index used when none is selected. It is stored
+// directly in the cache directory, where the single cache of earlier
+// versions was.
+const DefaultIndex = "default"
+
+// namedIndexDir is the subdirectory of the cache directory holding a
+// directory for every other index
+const namedIndexDir = "indexes"
+
+// namePattern restricts index names to ones that are safe as directory names
+var namePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// Indexes manages the named indexes kept in a cache directory. Each index
+// has its own cache files and lock.
+type Indexes struct {
+	cacheDir string
+
+	// Wait is copied to the caches opened by Open, and applies to Delete
+	// and Rename
+	Wait bool
+}
+
+// Summary describes a saved index
+type Summary struct {
+	Name     string
+	Path     string // The file Load reads the index from
+	Size     int64
+	Modified time.Time
+}
+
+// NewIndexes creates a new set of indexes in cacheDir
+func NewIndexes(cacheDir string) *Indexes {
+	return &Indexes{cacheDir: cacheDir, Wait: true}
+}
+
+// ValidateName checks that name can be used as an index name
+func ValidateName(name string) error {
+	if !namePattern.MatchString(name) {
+		return fmt.Errorf("invalid index name %q: use letters, digits, '.', '_' and '-', starting with a letter or digit", name)
+	}
+	return nil
+}
+
+// Dir returns the directory holding the named index
+func (x *Indexes) Dir(name string) string {
+	if name == DefaultIndex {
+		return x.cacheDir
+	}
+	return filepath.Join(x.cacheDir, namedIndexDir, name)
+}
+
+// Open returns the cache of the named index, which need not exist yet
+func (x *Indexes) Open(name string) (*Cache, error) {
+	if err := ValidateName(name); err != nil {
+		return nil, err
+	}
+	c := NewCache(x.Dir(name))
+	c.Wait = x.Wait
+	return c, nil
+}
+
+// List returns the saved indexes sorted by name
+func (x *Indexes) List() ([]Summary, error) {
+	names := []string{DefaultIndex}
+	entries, err := os.ReadDir(filepath.Join(x.cacheDir, namedIndexDir))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() && ValidateName(entry.Name()) == nil {
+			names = append(names, entry.Name())
+		}
+	}
+
+	var summaries []Summary
+	for _, name := range names {
+		c := NewCache(x.Dir(name))
+		path, info := c.existing()
+		if info == nil {
+			continue
+		}
+		summaries = append(summaries, Summary{
+			Name:     name,
+			Path:     path,
+			Size:     info.Size(),
+			Modified: info.ModTime(),
+		})
+	}
+
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].Name < summaries[j].Name
+	})
+	return summaries, nil
+}
+
+// Delete removes the named index once no other process is using it
+func (x *Indexes) Delete(name string) error {
+	c, err := x.Open(name)
+	if err != nil {
+		return err
+	}
+	// Checked before locking as well, which would create the index's directory
+	if _, info := c.existing(); info == nil {
+		return fmt.Errorf("index %q does not exist", name)
+	}
+	lock, err := c.Lock(true)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	if _, info := c.existing(); info == nil {
+		return fmt.Errorf("index %q does not exist", name)
+	}
+	for _, path := range c.files() {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if name != DefaultIndex {
+		// Also removes the lock file, which is still locked until Unlock
+		return os.RemoveAll(x.Dir(name))
+	}
+	return nil
+}
+
+// Rename renames an index once no other process is using it. The new name
+// must not be in use.
+func (x *Indexes) Rename(oldName, newName string) error {
+	from, err := x.Open(oldName)
+	if err != nil {
+		return err
+	}
+	to, err := x.Open(newName)
+	if err != nil {
+		return err
+	}
+	if oldName == newName {
+		return fmt.Errorf("index %q cannot be renamed to itself", oldName)
+	}
+	if err := checkRename(from, to, oldName, newName); err != nil {
+		return err
+	}
+
+	fromLock, err := from.Lock(true)
+	if err != nil {
+		return err
+	}
+	defer fromLock.Unlock()
+	toLock, err := to.Lock(true)
+	if err != nil {
+		return err
+	}
+	defer toLock.Unlock()
+
+	// Checked again now that no other process can create or remove either
+	if err := checkRename(from, to, oldName, newName); err != nil {
+		return err
+	}
+
+	targets := to.files()
+	for i, path := range from.files() {
+		// Clear leftovers such as a stale previous generation so that only
+		// the renamed index's files remain
+		if err := os.Remove(targets[i]); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := os.Rename(path, targets[i]); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if oldName != DefaultIndex {
+		return os.RemoveAll(x.Dir(oldName))
+	}
+	return nil
+}
+
+// checkRename checks that the index being renamed exists and that the new
+// name is free. It is checked before locking as well, which would create the
+// indexes' directories.
+func checkRename(from, to *Cache, oldName, newName string) error {
+	if _, info := from.existing(); info == nil {
+		return fmt.Errorf("index %q does not exist", oldName)
+	}
+	if _, info := to.existing(); info != nil {
+		return fmt.Errorf("index %q already exists", newName)
+	}
+	return nil
+}
+
+// files returns the paths of the files holding the cache, whether or not
+// they exist, in the order Load tries them
+func (c *Cache) files() []string {
+	return []string{c.filePath, c.filePath + previousSuffix, c.legacyPath}
+}
+
+// existing returns the first of the cache's files that exists, or a nil
+// FileInfo if there is none
+func (c *Cache) existing() (string, os.FileInfo) {
+	for _, path := range c.files() {
+		if info, err := os.Stat(path); err == nil {
+			return path, info
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,180 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// lockFileName is the file locked to coordinate processes sharing a cache.
+// An exclusive holder writes its PID into it so that others can name it;
+// shared holders leave it alone, since there may be several of them.
+const lockFileName = "cache.lock"
+
+// errWouldBlock is returned by flock when a non-blocking lock is held elsewhere
+var errWouldBlock = errors.New("lock is held by another process")
+
+// LockedError reports that another process holds the cache lock and the
+// cache is configured not to wait for it
+type LockedError struct {
+	PID int // Process holding the lock exclusively, or 0 if unknown
+}
+
+func (e *LockedError) Error() string {
+	if e.PID > 0 {
+		return fmt.Sprintf("cache is locked by another indexer process (PID %d)", e.PID)
+	}
+	return "cache is locked by another indexer process"
+}
+
+// Lock is an advisory lock on the cache held by this process. Shared locks
+// allow other readers; exclusive locks are held by a single writer.
+type Lock struct {
+	cache     *Cache
+	file      *os.File
+	exclusive bool
+}
+
+// Lock locks the cache until Unlock is called, for example to keep other
+// processes from saving between loading the cache and saving it again. Save
+// and Load lock the cache themselves unless a lock covering them is held.
+func (c *Cache) Lock(exclusive bool) (*Lock, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.held != nil {
+		return nil, errors.New("cache is already locked by this process")
+	}
+	l, err := c.lock(exclusive)
+	if err != nil {
+		return nil, err
+	}
+	c.held = l
+	return l, nil
+}
+
+// Unlock releases the lock
+func (l *Lock) Unlock() error {
+	l.cache.mu.Lock()
+	if l.cache.held == l {
+		l.cache.held = nil
+	}
+	l.cache.mu.Unlock()
+
+	if l.exclusive {
+		clearHolder(l.file)
+	}
+	err := funlock(l.file)
+	if closeErr := l.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// acquire locks the cache for a single operation and returns the function
+// that releases it. A lock already held by this process is reused, and a
+// shared one is upgraded for the duration of the operation if needed.
+func (c *Cache) acquire(exclusive bool) (func(), error) {
+	c.mu.Lock()
+	held := c.held
+	c.mu.Unlock()
+
+	if held == nil {
+		l, err := c.lock(exclusive)
+		if err != nil {
+			return nil, err
+		}
+		return func() { l.Unlock() }, nil
+	}
+	if held.exclusive || !exclusive {
+		return func() {}, nil
+	}
+	if err := c.flock(held.file, true); err != nil {
+		return nil, err
+	}
+	recordHolder(held.file)
+	return func() {
+		clearHolder(held.file)
+		flock(held.file, false, true)
+	}, nil
+}
+
+// lock opens the lock file and locks it
+func (c *Cache) lock(exclusive bool) (*Lock, error) {
+	path := c.lockPath()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.flock(file, exclusive); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	if exclusive {
+		recordHolder(file)
+	} else {
+		// No process holds the lock exclusively, so a PID left by one that
+		// exited without unlocking is stale
+		clearHolder(file)
+	}
+	return &Lock{cache: c, file: file, exclusive: exclusive}, nil
+}
+
+// recordHolder writes the PID of this process into the lock file, which it
+// holds exclusively
+func recordHolder(file *os.File) {
+	file.Truncate(0)
+	file.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+}
+
+// clearHolder empties the lock file while no other process holds the lock
+// exclusively
+func clearHolder(file *os.File) {
+	file.Truncate(0)
+}
+
+// flock takes a lock on file, waiting for other holders if the cache is
+// configured to wait and failing with a *LockedError otherwise
+func (c *Cache) flock(file *os.File, exclusive bool) error {
+	err := flock(file, exclusive, false)
+	if err != errWouldBlock {
+		return err
+	}
+
+	pid := c.holder()
+	if !c.Wait {
+		return &LockedError{PID: pid}
+	}
+	if pid > 0 {
+		slog.Info("waiting for the cache lock", "pid", pid)
+	} else {
+		slog.Info("waiting for the cache lock")
+	}
+	return flock(file, exclusive, true)
+}
+
+// holder returns the PID recorded in the lock file, or 0 if there is none
+func (c *Cache) holder() int {
+	content, err := os.ReadFile(c.lockPath())
+	if err != nil {
+		return 0
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil {
+		return 0
+	}
+	return pid
+}
+
+// lockPath returns the path of the lock file
+func (c *Cache) lockPath() string {
+	return filepath.Join(filepath.Dir(c.filePath), lockFileName)
+}
@@ -0,0 +1,16 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd)
+
+package cache
+
+import "os"
+
+// flock does nothing on platforms without flock(2); processes sharing a
+// cache there are not coordinated
+func flock(file *os.File, exclusive, block bool) error {
+	return nil
+}
+
+// funlock does nothing on platforms without flock(2)
+func funlock(file *os.File) error {
+	return nil
+}
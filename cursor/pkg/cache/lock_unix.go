@@ -0,0 +1,38 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package cache
+
+import (
+	"os"
+	"syscall"
+)
+
+// flock applies an advisory lock to file with flock(2). Without block it
+// returns errWouldBlock instead of waiting for another holder.
+func flock(file *os.File, exclusive, block bool) error {
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	if !block {
+		how |= syscall.LOCK_NB
+	}
+
+	for {
+		err := syscall.Flock(int(file.Fd()), how)
+		switch err {
+		case nil:
+			return nil
+		case syscall.EINTR:
+			continue
+		case syscall.EWOULDBLOCK:
+			return errWouldBlock
+		}
+		return &os.PathError{Op: "flock", Path: file.Name(), Err: err}
+	}
+}
+
+// funlock releases a lock taken with flock
+func funlock(file *os.File) error {
+	return syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+}
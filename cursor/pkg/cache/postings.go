@@ -0,0 +1,107 @@
+package cache
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+
+	"indexer/pkg/indexer"
+)
+
+// errBadPostings is returned when stored postings cannot be decoded
+var errBadPostings = errors.New("postings are damaged")
+
+// dictionary numbers the terms of a cache, so that every term is stored once
+// however many files contain it
+type dictionary struct {
+	terms []string
+	ids   map[string]uint64
+}
+
+// newDictionary creates an empty dictionary
+func newDictionary() *dictionary {
+	return &dictionary{ids: make(map[string]uint64)}
+}
+
+// id returns the number of a term, adding it to the dictionary if needed
+func (d *dictionary) id(term string) uint64 {
+	id, ok := d.ids[term]
+	if !ok {
+		id = uint64(len(d.terms))
+		d.ids[term] = id
+		d.terms = append(d.terms, term)
+	}
+	return id
+}
+
+// encodePostings appends the postings of a file to buf as varints: the
+// number of postings and of terms, then for every term its number in the
+// dictionary, its number of postings and the line of each posting, as the
+// difference from the previous one, and its column
+func (d *dictionary) encodePostings(buf []byte, postings map[string][]indexer.Posting) []byte {
+	total := 0
+	for _, list := range postings {
+		total += len(list)
+	}
+	buf = binary.AppendUvarint(buf, uint64(total))
+	buf = binary.AppendUvarint(buf, uint64(len(postings)))
+	for term, list := range postings {
+		buf = binary.AppendUvarint(buf, d.id(term))
+		buf = binary.AppendUvarint(buf, uint64(len(list)))
+		line := 0
+		for _, p := range list {
+			buf = binary.AppendUvarint(buf, uint64(p.Line-line))
+			buf = binary.AppendUvarint(buf, uint64(p.Column))
+			line = p.Line
+		}
+	}
+	return buf
+}
+
+// decodePostings decodes the postings encodePostings stored for the file
+// at path, looking terms up in the dictionary
+func decodePostings(path string, buf []byte, terms []string) (map[string][]indexer.Posting, error) {
+	bad := false
+	next := func() int {
+		v, n := binary.Uvarint(buf)
+		if n <= 0 || v > math.MaxInt {
+			bad = true
+			return 0
+		}
+		buf = buf[n:]
+		return int(v)
+	}
+
+	// Every posting and term takes at least two bytes, which bounds the
+	// allocations below by the size of the data
+	total := next()
+	termCount := next()
+	if bad || total > len(buf) || termCount > len(buf) {
+		return nil, errBadPostings
+	}
+	// All postings of the file share one slice
+	all := make([]indexer.Posting, total)
+	postings := make(map[string][]indexer.Posting, termCount)
+	for i := 0; i < termCount; i++ {
+		id := next()
+		count := next()
+		if bad || id >= len(terms) || count > len(all) {
+			return nil, errBadPostings
+		}
+		list := all[:count:count]
+		all = all[count:]
+		line := 0
+		for j := range list {
+			line += next()
+			list[j] = indexer.Posting{Path: path, Line: line, Column: next()}
+		}
+		if bad {
+			return nil, errBadPostings
+		}
+		postings[terms[id]] = list
+	}
+	if len(all) != 0 || len(buf) != 0 {
+		return nil, errBadPostings
+	}
+	return postings, nil
+}
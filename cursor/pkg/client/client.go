@@ -0,0 +1,126 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"indexer/pkg/query"
+	"indexer/pkg/server"
+)
+
+// dialTimeout bounds how long Available waits for a daemon to accept
+const dialTimeout = 200 * time.Millisecond
+
+// Client talks to an indexer daemon over its Unix domain socket using the
+// HTTP API of the server package
+type Client struct {
+	socket string
+	http   *http.Client
+}
+
+// New creates a client for the daemon listening on socket
+func New(socket string) *Client {
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	return &Client{
+		socket: socket,
+		http: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return dialer.DialContext(ctx, "unix", socket)
+				},
+			},
+		},
+	}
+}
+
+// Available reports whether a daemon is accepting connections on the socket
+func (c *Client) Available() bool {
+	conn, err := net.DialTimeout("unix", c.socket, dialTimeout)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// Search runs a search in the daemon, which gives up on it once ctx is done.
+// Context blocks are included in the response when before or after is positive.
+func (c *Client) Search(ctx context.Context, text string, opts query.Options, before, after int) (*server.SearchResponse, error) {
+	params := url.Values{}
+	params.Set("q", text)
+	params.Set("mode", opts.Mode.String())
+	params.Set("scope", opts.Scope.String())
+	params.Set("rank", strconv.FormatBool(opts.Rank))
+	if opts.Jobs > 0 {
+		params.Set("jobs", strconv.Itoa(opts.Jobs))
+	}
+	params.Set("B", strconv.Itoa(before))
+	params.Set("A", strconv.Itoa(after))
+
+	var response server.SearchResponse
+	if err := c.do(ctx, http.MethodGet, "/search", params, &response); err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
+
+// Reindex asks the daemon to index a directory, given as an absolute path,
+// and save its cache. Once ctx is done the daemon stops indexing and does not
+// save the cache.
+func (c *Client) Reindex(ctx context.Context, dir string) (*server.ReindexResponse, error) {
+	params := url.Values{}
+	params.Set("path", dir)
+
+	var response server.ReindexResponse
+	if err := c.do(ctx, http.MethodPost, "/reindex", params, &response); err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
+
+// Stats returns the daemon's index statistics
+func (c *Client) Stats() (*server.StatsResponse, error) {
+	var response server.StatsResponse
+	if err := c.do(context.Background(), http.MethodGet, "/stats", nil, &response); err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
+
+// do sends a request and decodes its JSON response into v. Error responses
+// are returned as errors carrying the daemon's message.
+func (c *Client) do(ctx context.Context, method, path string, params url.Values, v any) error {
+	// The host is ignored since every connection goes to the socket
+	u := "http://indexer" + path
+	if len(params) > 0 {
+		u += "?" + params.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("daemon request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var failure struct {
+			Error string `json:"error"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&failure); err != nil || failure.Error == "" {
+			return fmt.Errorf("daemon returned %s", resp.Status)
+		}
+		return errors.New(failure.Error)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,182 @@
+package format
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"indexer/pkg/search"
+)
+
+// Format is a machine-readable output format for search results
+type Format string
+
+const (
+	Text    Format = "text"    // Human-readable output printed by the CLI
+	JSON    Format = "json"    // A single JSON array of records
+	JSONL   Format = "jsonl"   // One JSON record per line
+	CSV     Format = "csv"     // Comma-separated records with a header row
+	Vimgrep Format = "vimgrep" // path:line:column:text, one line per match
+)
+
+// Record types
+const (
+	TypeMatch   = "match"   // A single match within a line
+	TypeContext = "context" // A line printed around matches
+	TypeFile    = "file"    // A file matched as a whole, e.g. by a path: qualifier
+)
+
+// Record is the stable schema of a search hit shared by every machine-readable
+// format. Lines and columns are 1-based, columns count bytes, and EndColumn is
+// exclusive. Context and file records have no column or match text, and file
+// records have no line. A line that matches without a span, such as through
+// a qualifier in an OR, has a single match record without column or match
+// text.
+type Record struct {
+	Type      string  `json:"type"`
+	Path      string  `json:"path"`
+	Line      int     `json:"line"`
+	Column    int     `json:"column"`
+	EndColumn int     `json:"end_column"`
+	Match     string  `json:"match"`
+	Text      string  `json:"text"`
+	Score     float64 `json:"score"`
+}
+
+// csvHeader lists the CSV columns in record field order
+var csvHeader = []string{"type", "path", "line", "column", "end_column", "match", "text", "score"}
+
+// Parse validates a format name
+func Parse(name string) (Format, error) {
+	switch f := Format(strings.ToLower(name)); f {
+	case Text, JSON, JSONL, CSV, Vimgrep:
+		return f, nil
+	}
+	return "", fmt.Errorf("unknown format %q (expected text, json, jsonl, csv or vimgrep)", name)
+}
+
+// FromResults converts search results into one record per match
+func FromResults(results []search.SearchResult) []Record {
+	records := make([]Record, 0, len(results))
+	for _, result := range results {
+		if result.LineNumber == 0 {
+			records = append(records, Record{Type: TypeFile, Path: result.FilePath, Score: result.Score})
+			continue
+		}
+		records = append(records, matchRecords(result.FilePath, result.LineNumber, result.Line, result.Matches, result.Score)...)
+	}
+	return records
+}
+
+// FromBlocks converts context blocks into match records for matching lines
+// and context records for the lines around them, in line order
+func FromBlocks(blocks []search.Block) []Record {
+	var records []Record
+	for _, block := range blocks {
+		if len(block.Lines) == 0 {
+			records = append(records, Record{Type: TypeFile, Path: block.FilePath, Score: block.Score})
+			continue
+		}
+		for _, line := range block.Lines {
+			if line.Match {
+				records = append(records, matchRecords(block.FilePath, line.LineNumber, line.Line, line.Matches, block.Score)...)
+				continue
+			}
+			records = append(records, Record{
+				Type:  TypeContext,
+				Path:  block.FilePath,
+				Line:  line.LineNumber,
+				Text:  line.Line,
+				Score: block.Score,
+			})
+		}
+	}
+	return records
+}
+
+// matchRecords creates a record for every match span of a line, or a single
+// record without a span if there are none
+func matchRecords(path string, lineNum int, line string, matches []search.Match, score float64) []Record {
+	if len(matches) == 0 {
+		return []Record{{Type: TypeMatch, Path: path, Line: lineNum, Text: line, Score: score}}
+	}
+	records := make([]Record, 0, len(matches))
+	for _, m := range matches {
+		record := Record{
+			Type:      TypeMatch,
+			Path:      path,
+			Line:      lineNum,
+			Column:    m.Column,
+			EndColumn: m.EndColumn,
+			Text:      line,
+			Score:     score,
+		}
+		if m.Column >= 1 && m.Column <= m.EndColumn && m.EndColumn-1 <= len(line) {
+			record.Match = line[m.Column-1 : m.EndColumn-1]
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+// Write encodes records to w in the given machine-readable format
+func Write(w io.Writer, f Format, records []Record) error {
+	switch f {
+	case JSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		if records == nil {
+			records = []Record{}
+		}
+		return encoder.Encode(records)
+
+	case JSONL:
+		encoder := json.NewEncoder(w)
+		for _, record := range records {
+			if err := encoder.Encode(record); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case CSV:
+		writer := csv.NewWriter(w)
+		if err := writer.Write(csvHeader); err != nil {
+			return err
+		}
+		for _, r := range records {
+			row := []string{
+				r.Type,
+				r.Path,
+				strconv.Itoa(r.Line),
+				strconv.Itoa(r.Column),
+				strconv.Itoa(r.EndColumn),
+				r.Match,
+				r.Text,
+				strconv.FormatFloat(r.Score, 'f', -1, 64),
+			}
+			if err := writer.Write(row); err != nil {
+				return err
+			}
+		}
+		writer.Flush()
+		return writer.Error()
+
+	case Vimgrep:
+		// Only matches carry a position an editor can jump to
+		for _, r := range records {
+			if r.Type != TypeMatch {
+				continue
+			}
+			// Editors expect a column even for a line matched without a span
+			if _, err := fmt.Fprintf(w, "%s:%d:%d:%s\n", r.Path, r.Line, max(r.Column, 1), r.Text); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("format %q is not machine-readable", f)
+}
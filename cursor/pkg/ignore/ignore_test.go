@@ -0,0 +1,177 @@
+package ignore
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGlobToRegexp(t *testing.T) {
+	tests := []struct {
+		glob string
+		want string
+	}{
+		{"*.log", `[^/]*\.log`},
+		{"?.go", `[^/]\.go`},
+		{"**", ".*"},
+		{"**/foo", "(?:.*/)?foo"},
+		{"a/**/b", "a/(?:.*/)?b"},
+		{"abc/**", "abc/.*"},
+		{"a**b", "a[^/]*b"},
+		{"[abc].txt", `[abc]\.txt`},
+		{"[!abc].txt", `[^abc]\.txt`},
+		{"[]a]", "[]a]"},
+		{"[abc", `\[abc`},
+		{`\*.txt`, `\*\.txt`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.glob, func(t *testing.T) {
+			if got := globToRegexp(tt.glob); got != tt.want {
+				t.Errorf("globToRegexp(%q) = %q, want %q", tt.glob, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRuleMatches(t *testing.T) {
+	const base = "/repo"
+	tests := []struct {
+		pattern string
+		path    string // Relative to base
+		isDir   bool
+		want    bool
+	}{
+		// Unanchored patterns match a name at any depth
+		{"*.log", "a.log", false, true},
+		{"*.log", "dir/sub/a.log", false, true},
+		{"*.log", "a.log.txt", false, false},
+		{"build", "src/build", true, true},
+
+		// A leading or inner slash anchors the pattern to its directory
+		{"/build", "build", true, true},
+		{"/build", "src/build", true, false},
+		{"doc/*.txt", "doc/a.txt", false, true},
+		{"doc/*.txt", "doc/sub/a.txt", false, false},
+		{"doc/*.txt", "x/doc/a.txt", false, false},
+
+		// "**" spans directories only as a whole segment
+		{"**/foo", "foo", false, true},
+		{"**/foo", "a/b/foo", false, true},
+		{"a/**/b", "a/b", false, true},
+		{"a/**/b", "a/x/y/b", false, true},
+		{"a/**/b", "a/xb", false, false},
+		{"abc/**", "abc/x/y", false, true},
+		{"abc/**", "abc", true, false},
+		{"a**b", "axxb", false, true},
+		{"a**b", "a/b", false, false},
+
+		// A trailing slash only matches directories
+		{"build/", "build", true, true},
+		{"build/", "build", false, false},
+		{"build/", "src/build", true, true},
+
+		// Escapes and classes
+		{"?.go", "a.go", false, true},
+		{"?.go", "ab.go", false, false},
+		{"[!a].go", "b.go", false, true},
+		{"[!a].go", "a.go", false, false},
+		{`\!important`, "!important", false, true},
+		{`\#notes`, "#notes", false, true},
+		{`trailing\ `, "trailing ", false, true},
+
+		// Paths outside the pattern's directory never match
+		{"*", "../other", false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.path, func(t *testing.T) {
+			r, ok := parseRule(tt.pattern, base)
+			if !ok {
+				t.Fatalf("parseRule(%q) found no pattern", tt.pattern)
+			}
+			path := filepath.Join(base, filepath.FromSlash(tt.path))
+			if got := r.matches(path, tt.isDir); got != tt.want {
+				t.Errorf("%q matches %q (dir %v) = %v, want %v", tt.pattern, tt.path, tt.isDir, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseRuleSkipsBlankLines(t *testing.T) {
+	for _, line := range []string{"", "   ", "# comment", "!", "/"} {
+		if _, ok := parseRule(line, "/repo"); ok {
+			t.Errorf("parseRule(%q) found a pattern", line)
+		}
+	}
+}
+
+func TestMatcher(t *testing.T) {
+	root := t.TempDir()
+	writeFile(t, root, ".git/info/exclude", "*.tmp\n")
+	writeFile(t, root, ".gitignore", "*.log\n!keep.log\nbuild/\n")
+	writeFile(t, root, "sub/.gitignore", "!*.tmp\n")
+	writeFile(t, root, "sub/.indexignore", "keep.log\n")
+	writeFile(t, root, "sub/deep/.gitignore", "/local.txt\n")
+
+	// A walk adds every directory it reaches, the root included
+	m := New(root)
+	m.AddDir(root)
+	m.AddDir(filepath.Join(root, "sub"))
+	m.AddDir(filepath.Join(root, "sub", "deep"))
+
+	tests := []struct {
+		path  string
+		isDir bool
+		want  bool
+	}{
+		{"a.log", false, true},
+		{"keep.log", false, false},          // Negated later in the same file
+		{"sub/a.log", false, true},          // Rules apply below their directory
+		{"sub/keep.log", false, true},       // A deeper ignore file takes precedence
+		{"a.tmp", false, true},              // From .git/info/exclude
+		{"sub/a.tmp", false, false},         // Re-included by a deeper file
+		{"build", true, true},               // A directory-only pattern matches a directory
+		{"build", false, false},             // but not a file
+		{"sub/deep/local.txt", false, true}, // Anchored to its directory
+		{"sub/deep/x/local.txt", false, false},
+		{"main.go", false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			path := filepath.Join(root, filepath.FromSlash(tt.path))
+			if got := m.Ignored(path, tt.isDir); got != tt.want {
+				t.Errorf("Ignored(%q, %v) = %v, want %v", tt.path, tt.isDir, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewLoadsParentIgnoreFiles(t *testing.T) {
+	repo := t.TempDir()
+	writeFile(t, repo, ".git/HEAD", "ref: refs/heads/main\n")
+	writeFile(t, repo, ".gitignore", "*.gen\n")
+	writeFile(t, repo, "src/.gitignore", "!keep.gen\n")
+
+	// Walking from a subdirectory still applies the rules above it
+	m := New(filepath.Join(repo, "src", "pkg"))
+	if !m.Ignored(filepath.Join(repo, "src", "pkg", "a.gen"), false) {
+		t.Error("a.gen is not ignored by the repository's .gitignore")
+	}
+	if m.Ignored(filepath.Join(repo, "src", "pkg", "keep.gen"), false) {
+		t.Error("keep.gen is ignored despite being re-included in src/.gitignore")
+	}
+}
+
+// writeFile creates a file beneath dir, along with its parent directories
+func writeFile(t *testing.T, dir, name, content string) {
+	t.Helper()
+	path := filepath.Join(dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,212 @@
+package indexer
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"indexer/pkg/ignore"
+)
+
+// sniffSize is how much of a file is read to decide whether it holds text
+const sniffSize = 8 * 1024
+
+// maxFileSize is the largest file that is indexed (100MB)
+const maxFileSize = 100 * 1024 * 1024
+
+// skippedDirs are directories that are never walked, with a description
+// used when explaining why a file is skipped: version control metadata and
+// project-local indexer caches
+var skippedDirs = map[string]string{
+	".git":     "git directory",
+	".indexer": "indexer cache directory",
+}
+
+// SkippedDir reports whether directories called name are left out of the
+// walk, whatever the ignore files say
+func SkippedDir(name string) bool {
+	_, ok := skippedDirs[name]
+	return ok
+}
+
+// binaryExts are extensions that are always treated as binary
+var binaryExts = map[string]bool{
+	".exe": true, ".dll": true, ".so": true, ".dylib": true,
+	".bin": true, ".obj": true, ".o": true, ".a": true,
+	".lib": true, ".pyc": true, ".class": true, ".jar": true,
+	".war": true, ".ear": true, ".zip": true, ".tar": true,
+	".gz": true, ".7z": true, ".rar": true, ".pdf": true,
+	".jpg": true, ".jpeg": true, ".png": true, ".gif": true,
+	".bmp": true, ".ico": true, ".mp3": true, ".mp4": true,
+	".avi": true, ".mov": true, ".wmv": true, ".flv": true,
+}
+
+// textExts are extensions that are always treated as text, whatever their content
+var textExts = map[string]bool{
+	".txt": true, ".md": true, ".json": true, ".xml": true,
+	".html": true, ".htm": true, ".css": true, ".js": true,
+	".ts": true, ".go": true, ".py": true, ".java": true,
+	".c": true, ".cpp": true, ".h": true, ".hpp": true,
+	".cs": true, ".php": true, ".rb": true, ".rs": true,
+	".sh": true, ".yaml": true, ".yml": true, ".toml": true,
+	".ini": true, ".cfg": true, ".conf": true, ".csv": true,
+}
+
+// skipError reports that a file was left out of the index on purpose
+type skipError struct {
+	reason string
+}
+
+func (e *skipError) Error() string {
+	return e.reason
+}
+
+// detectText decides whether a file holds text from its extension or, when
+// the extension is not conclusive, from the first bytes of its content.
+// It returns a short description of what decided the outcome.
+func detectText(path string, head []byte) (bool, string) {
+	ext := strings.ToLower(filepath.Ext(path))
+	if textExts[ext] {
+		return true, fmt.Sprintf("text extension %s", ext)
+	}
+	if binaryExts[ext] {
+		return false, fmt.Sprintf("binary extension %s", ext)
+	}
+
+	if len(head) == 0 {
+		return true, "empty file"
+	}
+	if bytes.IndexByte(head, 0) >= 0 {
+		return false, "content contains NUL bytes"
+	}
+	if validUTF8Prefix(head) {
+		return true, "content is valid UTF-8"
+	}
+	contentType := http.DetectContentType(head)
+	if strings.HasPrefix(contentType, "text/") {
+		return true, fmt.Sprintf("content type %s", contentType)
+	}
+	return false, fmt.Sprintf("content type %s", contentType)
+}
+
+// validUTF8Prefix reports whether b is valid UTF-8, allowing the last rune
+// to be cut short by the end of the sniffed prefix
+func validUTF8Prefix(b []byte) bool {
+	for i := 0; i < utf8.UTFMax && i < len(b); i++ {
+		end := len(b) - i
+		if utf8.Valid(b[:end]) {
+			// Whatever follows must be the start of an incomplete rune
+			return i == 0 || !utf8.FullRune(b[end:])
+		}
+	}
+	return false
+}
+
+// readHead reads up to sniffSize bytes from the start of a file
+func readHead(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	head := make([]byte, sniffSize)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	return head[:n], nil
+}
+
+// skipReason returns why a file is left out of the index before its content
+// is looked at, or an empty string if it should be read
+func skipReason(path string, info os.FileInfo, matcher *ignore.Matcher) string {
+	if ignored, source := matcher.Match(path, false); ignored {
+		return fmt.Sprintf("ignored by %s", source)
+	}
+	if strings.HasPrefix(info.Name(), ".") {
+		return "hidden file"
+	}
+	if info.Size() > maxFileSize {
+		return fmt.Sprintf("too large: %.2f MB", float64(info.Size())/(1024*1024))
+	}
+	return ""
+}
+
+// Explain reports whether a file would be indexed and why. The ignore rules
+// are those of the indexed root containing the file, or of the file's own
+// directory if no root contains it.
+func (idx *Index) Explain(path string) (bool, string, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return false, "", err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return false, "", err
+	}
+	if info.IsDir() {
+		return false, "", fmt.Errorf("%s is a directory", path)
+	}
+
+	root, ok := idx.rootFor(path)
+	if !ok {
+		root = filepath.Dir(path)
+	}
+	if reason := walkReason(path, info, root); reason != "" {
+		return false, reason, nil
+	}
+
+	head, err := readHead(path)
+	if err != nil {
+		return false, "", err
+	}
+	text, reason := detectText(path, head)
+	if !text {
+		return false, "binary: " + reason, nil
+	}
+	return true, "text: " + reason, nil
+}
+
+// rootFor returns the innermost indexed root containing path
+func (idx *Index) rootFor(path string) (string, bool) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	best := ""
+	for root := range idx.roots {
+		if withinRoot(path, root) && len(root) > len(best) {
+			best = root
+		}
+	}
+	return best, best != ""
+}
+
+// walkReason replays a walk of root down to a single file and returns why
+// the walk would skip it before looking at its content, or an empty string
+// if it would be read
+func walkReason(path string, info os.FileInfo, root string) string {
+	matcher := ignore.New(root)
+	matcher.AddDir(root)
+
+	var dirs []string
+	for dir := filepath.Dir(path); dir != root && withinRoot(dir, root); dir = filepath.Dir(dir) {
+		dirs = append(dirs, dir)
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		dir := dirs[i]
+		if kind, ok := skippedDirs[filepath.Base(dir)]; ok {
+			return fmt.Sprintf("inside %s %s", kind, dir)
+		}
+		if ignored, source := matcher.Match(dir, true); ignored {
+			return fmt.Sprintf("inside directory %s, ignored by %s", dir, source)
+		}
+		matcher.AddDir(dir)
+	}
+	return skipReason(path, info, matcher)
+}
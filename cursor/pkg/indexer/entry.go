@@ -0,0 +1,120 @@
+package indexer
+
+import (
+	"iter"
+	"sort"
+	"strings"
+)
+
+// FileEntry represents an indexed file with its content information. The
+// content is stored once, with the offset of every line, and lines are
+// read through the accessor methods. Lines end at "\n", which is not part
+// of the line; a "\r" before it is.
+type FileEntry struct {
+	Path     string
+	Modified int64 // Last modified timestamp
+	Size     int64 // File size in bytes when indexed
+
+	content  string
+	starts   []uint32             // Byte offset of the start of every line
+	postings map[string][]Posting // Occurrences of every term in the content
+}
+
+// NewFileEntry creates an entry holding content, tokenizing it
+func NewFileEntry(path, content string, modified, size int64) *FileEntry {
+	entry := NewFileEntryWithPostings(path, content, modified, size, nil)
+	entry.postings = buildPostings(entry)
+	return entry
+}
+
+// NewFileEntryWithPostings creates an entry holding content whose terms
+// have already been found, such as one loaded from the cache. The postings
+// must be those NewFileEntry would find.
+func NewFileEntryWithPostings(path, content string, modified, size int64, postings map[string][]Posting) *FileEntry {
+	return &FileEntry{
+		Path:     path,
+		Modified: modified,
+		Size:     size,
+		content:  content,
+		starts:   lineStarts(content),
+		postings: postings,
+	}
+}
+
+// NewFileEntryFromLines creates an entry from its lines, for data stored
+// line by line
+func NewFileEntryFromLines(path string, lines []string, modified, size int64) *FileEntry {
+	content := strings.Join(lines, "\n")
+	if len(lines) > 0 && lines[len(lines)-1] == "" {
+		// Keep a final empty line, which joining alone would drop
+		content += "\n"
+	}
+	return NewFileEntry(path, content, modified, size)
+}
+
+// lineStarts returns the offset of every line in content. A final "\n"
+// ends the last line rather than starting an empty one.
+func lineStarts(content string) []uint32 {
+	if content == "" {
+		return nil
+	}
+	starts := make([]uint32, 1, strings.Count(content, "\n")+1)
+	for i := 0; i < len(content); i++ {
+		if content[i] == '\n' && i+1 < len(content) {
+			starts = append(starts, uint32(i+1))
+		}
+	}
+	return starts
+}
+
+// Content returns the indexed content of the file
+func (e *FileEntry) Content() string {
+	return e.content
+}
+
+// Postings returns the occurrences of every term in the content. The
+// returned map must not be modified.
+func (e *FileEntry) Postings() map[string][]Posting {
+	return e.postings
+}
+
+// LineCount returns the number of lines in the file
+func (e *FileEntry) LineCount() int {
+	return len(e.starts)
+}
+
+// Line returns line n, counting from 1, or an empty string if there is no
+// such line
+func (e *FileEntry) Line(n int) string {
+	if n < 1 || n > len(e.starts) {
+		return ""
+	}
+	end := len(e.content)
+	if n < len(e.starts) {
+		end = int(e.starts[n])
+	}
+	return strings.TrimSuffix(e.content[e.starts[n-1]:end], "\n")
+}
+
+// LineOf returns the number of the line containing the byte at offset, or 0
+// if the offset is outside the content
+func (e *FileEntry) LineOf(offset int) int {
+	if offset < 0 || offset >= len(e.content) {
+		return 0
+	}
+	// The first line starting after the offset follows the one containing it
+	return sort.Search(len(e.starts), func(i int) bool {
+		return int(e.starts[i]) > offset
+	})
+}
+
+// Lines iterates over the lines of the file in order with their numbers
+func (e *FileEntry) Lines() iter.Seq2[int, string] {
+	return func(yield func(int, string) bool) {
+		for n := 1; n <= len(e.starts); n++ {
+			if !yield(n, e.Line(n)) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package indexer
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestFileEntryLines(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		lines   []string
+	}{
+		{"empty", "", nil},
+		{"single line", "foo", []string{"foo"}},
+		{"single line with newline", "foo\n", []string{"foo"}},
+		{"without trailing newline", "foo\nbar", []string{"foo", "bar"}},
+		{"with trailing newline", "foo\nbar\n", []string{"foo", "bar"}},
+		{"final empty line", "foo\n\n", []string{"foo", ""}},
+		{"only a newline", "\n", []string{""}},
+		{"blank lines", "\n\nfoo\n\n", []string{"", "", "foo", ""}},
+		{"crlf", "foo\r\nbar\r\n", []string{"foo\r", "bar\r"}},
+		{"crlf without trailing newline", "foo\r\nbar", []string{"foo\r", "bar"}},
+		{"lone carriage return", "foo\rbar\n", []string{"foo\rbar"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := NewFileEntry("/a", tt.content, 0, 0)
+			if got := e.LineCount(); got != len(tt.lines) {
+				t.Errorf("LineCount() = %d, want %d", got, len(tt.lines))
+			}
+			for i, want := range tt.lines {
+				if got := e.Line(i + 1); got != want {
+					t.Errorf("Line(%d) = %q, want %q", i+1, got, want)
+				}
+			}
+			// Lines outside the file are empty
+			for _, n := range []int{-1, 0, len(tt.lines) + 1} {
+				if got := e.Line(n); got != "" {
+					t.Errorf("Line(%d) = %q, want \"\"", n, got)
+				}
+			}
+
+			var got []string
+			for n, line := range e.Lines() {
+				if n != len(got)+1 {
+					t.Errorf("Lines() yielded line %d after %d lines", n, len(got))
+				}
+				got = append(got, line)
+			}
+			if !slices.Equal(got, tt.lines) {
+				t.Errorf("Lines() = %q, want %q", got, tt.lines)
+			}
+
+			// Rebuilding the entry from its lines keeps them
+			if rebuilt := NewFileEntryFromLines("/a", tt.lines, 0, 0); rebuilt.LineCount() != len(tt.lines) {
+				t.Errorf("NewFileEntryFromLines(%q) has %d lines, want %d", tt.lines, rebuilt.LineCount(), len(tt.lines))
+			}
+		})
+	}
+}
+
+func TestFileEntryLineOf(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []int // Line of every offset, from -1 to one past the end
+	}{
+		{"empty", "", []int{0, 0}},
+		{"single line", "ab", []int{0, 1, 1, 0}},
+		// A newline belongs to the line it ends
+		{"with trailing newline", "a\nb\n", []int{0, 1, 1, 2, 2, 0}},
+		{"without trailing newline", "a\nb", []int{0, 1, 1, 2, 0}},
+		{"empty lines", "\n\n", []int{0, 1, 2, 0}},
+		{"crlf", "a\r\nb", []int{0, 1, 1, 1, 2, 0}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := NewFileEntry("/a", tt.content, 0, 0)
+			for i, want := range tt.want {
+				offset := i - 1
+				if got := e.LineOf(offset); got != want {
+					t.Errorf("LineOf(%d) in %q = %d, want %d", offset, tt.content, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestNewFileEntryFromLines(t *testing.T) {
+	tests := []struct {
+		lines []string
+		want  string
+	}{
+		{nil, ""},
+		{[]string{"foo"}, "foo"},
+		{[]string{"foo", "bar"}, "foo\nbar"},
+		{[]string{"foo", ""}, "foo\n\n"},
+		{[]string{""}, "\n"},
+		{[]string{"foo\r", "bar\r"}, "foo\r\nbar\r"},
+	}
+
+	for _, tt := range tests {
+		e := NewFileEntryFromLines("/a", tt.lines, 0, 0)
+		if got := e.Content(); got != tt.want {
+			t.Errorf("NewFileEntryFromLines(%q) has content %q, want %q", tt.lines, got, tt.want)
+		}
+	}
+}
@@ -2,32 +2,55 @@ package indexer
 
 import (
 	"bufio"
-	"bytes"
+	"context"
 	"fmt"
+	"io"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync"
 	"sync/atomic"
-)
+	"time"
 
-// Maximum size for the scanner buffer (16MB)
-const maxScannerBufferSize = 16 * 1024 * 1024
+	"indexer/pkg/ignore"
+)
 
-// FileEntry represents an indexed file with its content information
-type FileEntry struct {
-	Path      string         `json:"path"`
-	LineIndex map[int]string `json:"line_index"` // Maps line numbers to content
-	Modified  int64          `json:"modified"`   // Last modified timestamp
+// ChangeStats summarises how the last IndexDirectory run changed the index
+type ChangeStats struct {
+	Added     uint64 `json:"added"`
+	Updated   uint64 `json:"updated"`
+	Removed   uint64 `json:"removed"`
+	Unchanged uint64 `json:"unchanged"`
 }
 
 // Index represents the main indexer that manages file scanning and indexing
 type Index struct {
-	mu      sync.RWMutex
-	files   map[string]*FileEntry // Maps file paths to their entries
-	workers int                   // Number of concurrent workers
-	indexed uint64                // Number of files indexed
-	skipped uint64                // Number of files skipped
+	mu        sync.RWMutex
+	files     map[string]*FileEntry           // Maps file paths to their entries
+	terms     map[string]map[string][]Posting // Inverted index from term to its occurrences in each file
+	termIDs   map[string]uint32               // Maps every term to its number in termList
+	termList  []string                        // Every term by number, or "" once it is removed
+	grams     map[uint32][]uint32             // Maps every gramSize-byte substring of a term to the numbers of the terms containing it
+	deadTerms int                             // Number of removed terms still numbered in termList and grams
+	roots     map[string]*Root                // Maps root directories to their details
+	lengths   map[string]int                  // Maps file paths to their number of terms
+	totalLen  int                             // Sum of all file lengths in terms
+	workers   int                             // Number of concurrent workers
+	indexed   uint64                          // Number of files indexed
+	skipped   uint64                          // Number of files skipped
+	added     uint64                          // Number of new files indexed
+	updated   uint64                          // Number of changed files re-indexed
+	removed   uint64                          // Number of entries dropped for missing files
+	unchanged uint64                          // Number of files reused from the previous index
+
+	// Progress of the running IndexDirectory call, reported through progress
+	progress      func(Progress) // Called every progressEvery, if set
+	progressEvery time.Duration
+	discovered    uint64 // Number of files found by the walk
+	processed     uint64 // Number of files dealt with in any way
+	bytesRead     uint64 // Number of bytes read from indexed files
+	walked        uint32 // Set to 1 once the walk has finished
 }
 
 // NewIndex creates a new indexer instance
@@ -37,58 +60,119 @@ func NewIndex(workers int) *Index {
 	}
 	return &Index{
 		files:   make(map[string]*FileEntry),
+		terms:   make(map[string]map[string][]Posting),
+		termIDs: make(map[string]uint32),
+		grams:   make(map[uint32][]uint32),
+		roots:   make(map[string]*Root),
+		lengths: make(map[string]int),
 		workers: workers,
 	}
 }
 
-// IndexDirectory recursively indexes all files in the given directory
+// IndexDirectory recursively indexes all files in the given directory and
+// adds it to the set of roots, leaving files from other roots untouched.
+// Files whose modification time and size match their existing entry are
+// kept as they are, and entries for files that are no longer found are dropped.
 func (idx *Index) IndexDirectory(root string) error {
-	fmt.Printf("Starting indexing of directory: %s\n", root)
+	return idx.IndexDirectoryContext(context.Background(), root)
+}
 
-	// Reset counters and clear existing files
-	atomic.StoreUint64(&idx.indexed, 0)
-	atomic.StoreUint64(&idx.skipped, 0)
+// IndexDirectoryContext is like IndexDirectory but stops walking the
+// directory once ctx is done and returns its error after the workers have
+// finished the files they were indexing. Those files stay in the index, but
+// missing files are not dropped and the root is not updated, so the index
+// should not be saved.
+func (idx *Index) IndexDirectoryContext(ctx context.Context, root string) error {
+	slog.Debug("indexing directory", "root", root)
 
-	idx.mu.Lock()
-	idx.files = make(map[string]*FileEntry)
-	idx.mu.Unlock()
+	root = filepath.Clean(root)
+	info, err := os.Stat(root)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", root)
+	}
 
-	// Create a channel to send file paths to workers
+	// Reset counters
+	atomic.StoreUint64(&idx.indexed, 0)
+	atomic.StoreUint64(&idx.skipped, 0)
+	atomic.StoreUint64(&idx.added, 0)
+	atomic.StoreUint64(&idx.updated, 0)
+	atomic.StoreUint64(&idx.removed, 0)
+	atomic.StoreUint64(&idx.unchanged, 0)
+	atomic.StoreUint64(&idx.discovered, 0)
+	atomic.StoreUint64(&idx.processed, 0)
+	atomic.StoreUint64(&idx.bytesRead, 0)
+	atomic.StoreUint32(&idx.walked, 0)
+	stopProgress := idx.reportProgress(root, time.Now())
+	defer stopProgress()
+
+	// Paths found during the walk, only touched by the walking goroutine
+	seen := make(map[string]bool)
+
+	// Create a channel to send file paths to workers, through a queue that
+	// lets the walk run ahead of them
+	found := make(chan string)
 	paths := make(chan string)
 	errors := make(chan error)
 	var wg sync.WaitGroup
+	go queuePaths(found, paths)
 
 	// Start worker goroutines
 	for i := 0; i < idx.workers; i++ {
 		wg.Add(1)
-		go idx.worker(paths, errors, &wg)
+		go idx.worker(ctx, paths, errors, &wg)
 	}
 
-	// Start a goroutine to walk the directory
+	// Start a goroutine to walk the directory, honouring ignore files
+	matcher := ignore.New(root)
 	go func() {
-		defer close(paths)
+		defer close(found)
 		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
 			if err != nil {
-				fmt.Printf("Warning: error accessing %s: %v\n", path, err)
+				slog.Warn("cannot access path", "path", path, "error", err)
 				return nil
 			}
-			if !info.IsDir() {
-				// Skip binary files, hidden files, and very large files
-				if isBinaryFile(path) || strings.HasPrefix(filepath.Base(path), ".") {
-					fmt.Printf("Skipping file: %s (binary or hidden)\n", path)
-					atomic.AddUint64(&idx.skipped, 1)
-					return nil
-				}
-				if info.Size() > 100*1024*1024 {
-					fmt.Printf("Skipping file: %s (too large: %.2f MB)\n", path, float64(info.Size())/(1024*1024))
-					atomic.AddUint64(&idx.skipped, 1)
-					return nil
+			if info.IsDir() {
+				if path != root && (SkippedDir(info.Name()) || matcher.Ignored(path, true)) {
+					return filepath.SkipDir
 				}
-				paths <- path
+				matcher.AddDir(path)
+				return nil
+			}
+			// Skip ignored files, hidden files, and very large files. Binary
+			// files are detected by the workers from their content.
+			atomic.AddUint64(&idx.discovered, 1)
+			if reason := skipReason(path, info, matcher); reason != "" {
+				slog.Debug("skipping file", "path", path, "reason", reason)
+				atomic.AddUint64(&idx.skipped, 1)
+				atomic.AddUint64(&idx.processed, 1)
+				return nil
+			}
+
+			absPath, err := filepath.Abs(path)
+			if err != nil {
+				absPath = path
+			}
+			seen[absPath] = true
+			if entry, ok := idx.GetFile(absPath); ok && entry.Modified == info.ModTime().Unix() && entry.Size == info.Size() {
+				atomic.AddUint64(&idx.unchanged, 1)
+				atomic.AddUint64(&idx.processed, 1)
+				return nil
+			}
+			select {
+			case found <- path:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
 			}
-			return nil
 		})
-		if err != nil {
+		atomic.StoreUint32(&idx.walked, 1)
+		if err != nil && ctx.Err() == nil {
 			errors <- fmt.Errorf("walk error: %w", err)
 		}
 	}()
@@ -102,62 +186,88 @@ func (idx *Index) IndexDirectory(root string) error {
 	// Collect any errors
 	for err := range errors {
 		if err != nil {
-			fmt.Printf("Error during indexing: %v\n", err)
+			slog.Warn("indexing error", "error", err)
 		}
 	}
+	stopProgress()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 
-	// Print statistics
-	indexed := atomic.LoadUint64(&idx.indexed)
-	skipped := atomic.LoadUint64(&idx.skipped)
-
-	idx.mu.RLock()
+	// Drop entries under this root for files that were deleted or are now skipped
+	idx.mu.Lock()
+	for path := range idx.files {
+		if withinRoot(path, root) && !seen[path] {
+			idx.removeLocked(path)
+			atomic.AddUint64(&idx.removed, 1)
+		}
+	}
+	idx.roots[root] = &Root{
+		Path:      root,
+		Files:     idx.countWithinLocked(root),
+		IndexedAt: time.Now(),
+	}
 	totalFiles := len(idx.files)
-	idx.mu.RUnlock()
-
-	fmt.Printf("\nIndexing complete:\n")
-	fmt.Printf("- Files processed: %d\n", indexed+skipped)
-	fmt.Printf("- Files indexed: %d\n", indexed)
-	fmt.Printf("- Files skipped: %d\n", skipped)
-	fmt.Printf("- Total files in index: %d\n", totalFiles)
+	idx.mu.Unlock()
 
-	// Print first few indexed files as debug info
-	idx.mu.RLock()
-	fmt.Println("\nFirst few indexed files:")
-	count := 0
-	for path, entry := range idx.files {
-		if count >= 5 {
-			break
-		}
-		lineCount := len(entry.LineIndex)
-		relPath, err := filepath.Rel(root, path)
-		if err != nil {
-			relPath = path
-		}
-		fmt.Printf("- %s (%d lines)\n", relPath, lineCount)
-		// Print first few lines as sample
-		if lineCount > 0 {
-			fmt.Printf("  Sample lines:\n")
-			sampleCount := 0
-			for i := 1; i <= lineCount && sampleCount < 3; i++ {
-				if line, ok := entry.LineIndex[i]; ok {
-					fmt.Printf("    %d: %s\n", i, line)
-					sampleCount++
+	// Log statistics
+	indexed := atomic.LoadUint64(&idx.indexed)
+	skipped := atomic.LoadUint64(&idx.skipped)
+	changes := idx.Changes()
+	slog.Debug("indexing complete",
+		"root", root,
+		"processed", indexed+skipped+changes.Unchanged,
+		"indexed", indexed,
+		"skipped", skipped,
+		"added", changes.Added,
+		"updated", changes.Updated,
+		"removed", changes.Removed,
+		"unchanged", changes.Unchanged,
+		"total", totalFiles)
+
+	// Log the first few indexed files with a sample of their lines
+	if slog.Default().Enabled(ctx, slog.LevelDebug) {
+		idx.mu.RLock()
+		count := 0
+		for path, entry := range idx.files {
+			if count >= 5 {
+				break
+			}
+			relPath, err := filepath.Rel(root, path)
+			if err != nil {
+				relPath = path
+			}
+			var sample []string
+			for _, line := range entry.Lines() {
+				if len(sample) >= 3 {
+					break
 				}
+				sample = append(sample, line)
 			}
+			slog.Debug("indexed file", "path", relPath, "lines", entry.LineCount(), "sample", sample)
+			count++
 		}
-		count++
+		idx.mu.RUnlock()
 	}
-	idx.mu.RUnlock()
 
 	return nil
 }
 
-// worker processes files from the paths channel
-func (idx *Index) worker(paths <-chan string, errors chan<- error, wg *sync.WaitGroup) {
+// worker processes files from the paths channel. Once ctx is done the
+// remaining paths are drained without being indexed.
+func (idx *Index) worker(ctx context.Context, paths <-chan string, errors chan<- error, wg *sync.WaitGroup) {
 	defer wg.Done()
 
 	for path := range paths {
-		if err := idx.indexFile(path); err != nil {
+		if ctx.Err() != nil {
+			continue
+		}
+		err := idx.indexFile(path)
+		atomic.AddUint64(&idx.processed, 1)
+		if skip, ok := err.(*skipError); ok {
+			slog.Debug("skipping file", "path", path, "reason", skip.reason)
+			atomic.AddUint64(&idx.skipped, 1)
+		} else if err != nil {
 			errors <- fmt.Errorf("error indexing %s: %w", path, err)
 		} else {
 			atomic.AddUint64(&idx.indexed, 1)
@@ -165,25 +275,8 @@ func (idx *Index) worker(paths <-chan string, errors chan<- error, wg *sync.Wait
 	}
 }
 
-// isBinaryFile checks if a file is likely to be binary
-func isBinaryFile(path string) bool {
-	// Common binary file extensions
-	binaryExts := map[string]bool{
-		".exe": true, ".dll": true, ".so": true, ".dylib": true,
-		".bin": true, ".obj": true, ".o": true, ".a": true,
-		".lib": true, ".pyc": true, ".class": true, ".jar": true,
-		".war": true, ".ear": true, ".zip": true, ".tar": true,
-		".gz": true, ".7z": true, ".rar": true, ".pdf": true,
-		".jpg": true, ".jpeg": true, ".png": true, ".gif": true,
-		".bmp": true, ".ico": true, ".mp3": true, ".mp4": true,
-		".avi": true, ".mov": true, ".wmv": true, ".flv": true,
-	}
-
-	ext := strings.ToLower(filepath.Ext(path))
-	return binaryExts[ext]
-}
-
-// indexFile indexes a single file
+// indexFile indexes a single file. Files whose content turns out to be
+// binary are dropped from the index and reported with a *skipError.
 func (idx *Index) indexFile(path string) error {
 	absPath, err := filepath.Abs(path)
 	if err != nil {
@@ -201,48 +294,44 @@ func (idx *Index) indexFile(path string) error {
 		return fmt.Errorf("failed to stat file: %w", err)
 	}
 
-	// Create a new entry for the file
-	entry := &FileEntry{
-		Path:      absPath,
-		LineIndex: make(map[int]string),
-		Modified:  info.ModTime().Unix(),
+	// Sniff the start of the file before reading the rest
+	reader := bufio.NewReaderSize(file, sniffSize)
+	head, err := reader.Peek(sniffSize)
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("failed to read file: %w", err)
 	}
-
-	// Create a scanner with a larger buffer
-	scanner := bufio.NewScanner(file)
-	buf := make([]byte, maxScannerBufferSize)
-	scanner.Buffer(buf, maxScannerBufferSize)
-
-	// Use custom split function to handle longer lines
-	scanner.Split(func(data []byte, atEOF bool) (advance int, token []byte, err error) {
-		if atEOF && len(data) == 0 {
-			return 0, nil, nil
-		}
-		if i := bytes.IndexByte(data, '\n'); i >= 0 {
-			// Return the line without the newline character
-			return i + 1, data[0:i], nil
+	if text, reason := detectText(path, head); !text {
+		idx.mu.Lock()
+		if _, ok := idx.files[absPath]; ok {
+			idx.removeLocked(absPath)
+			atomic.AddUint64(&idx.removed, 1)
 		}
-		if atEOF {
-			return len(data), data, nil
-		}
-		return 0, nil, nil
-	})
-
-	lineNum := 1
-	for scanner.Scan() {
-		entry.LineIndex[lineNum] = scanner.Text()
-		lineNum++
+		idx.mu.Unlock()
+		return &skipError{reason: "binary: " + reason}
 	}
 
-	if err := scanner.Err(); err != nil {
-		return fmt.Errorf("error scanning file: %w", err)
+	// Read the content straight into the string the entry keeps
+	var content strings.Builder
+	content.Grow(int(info.Size()))
+	if _, err := io.Copy(&content, reader); err != nil {
+		return fmt.Errorf("error reading file: %w", err)
 	}
+	atomic.AddUint64(&idx.bytesRead, uint64(content.Len()))
+
+	// Tokenize outside the lock, then store the entry with its postings
+	entry := NewFileEntry(absPath, content.String(), info.ModTime().Unix(), info.Size())
 
-	// Store the entry in the index
 	idx.mu.Lock()
-	idx.files[absPath] = entry
+	_, existed := idx.files[absPath]
+	idx.storeLocked(entry)
 	idx.mu.Unlock()
 
+	if existed {
+		atomic.AddUint64(&idx.updated, 1)
+	} else {
+		atomic.AddUint64(&idx.added, 1)
+	}
+
 	return nil
 }
 
@@ -256,11 +345,37 @@ func (idx *Index) GetFiles() map[string]*FileEntry {
 		files[k] = v
 	}
 
-	fmt.Printf("GetFiles called - returning %d files\n", len(files))
+	slog.Debug("GetFiles called", "files", len(files))
 	return files
 }
 
+// GetFile returns the entry for a single indexed file
+func (idx *Index) GetFile(path string) (*FileEntry, bool) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	entry, ok := idx.files[path]
+	return entry, ok
+}
+
+// FileCount returns the number of files in the index
+func (idx *Index) FileCount() int {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	return len(idx.files)
+}
+
 // Stats returns the current indexing statistics
 func (idx *Index) Stats() (indexed, skipped uint64) {
 	return atomic.LoadUint64(&idx.indexed), atomic.LoadUint64(&idx.skipped)
 }
+
+// Changes returns how the last IndexDirectory run changed the index
+func (idx *Index) Changes() ChangeStats {
+	return ChangeStats{
+		Added:     atomic.LoadUint64(&idx.added),
+		Updated:   atomic.LoadUint64(&idx.updated),
+		Removed:   atomic.LoadUint64(&idx.removed),
+		Unchanged: atomic.LoadUint64(&idx.unchanged),
+	}
+}
@@ -0,0 +1,134 @@
+package indexer
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Progress is a snapshot of a running IndexDirectory call
+type Progress struct {
+	Root       string        // Directory being indexed
+	Discovered uint64        // Files found by the walk so far, skipped ones included
+	Processed  uint64        // Files indexed, skipped, unchanged or failed
+	Indexed    uint64        // Files read and indexed
+	Bytes      uint64        // Bytes read from indexed files
+	Elapsed    time.Duration // Time since indexing started
+	Walked     bool          // The walk has finished, so Discovered is the total
+	Done       bool          // Indexing has finished or been cancelled
+}
+
+// FilesPerSecond returns the number of files processed per second so far
+func (p Progress) FilesPerSecond() float64 {
+	if p.Elapsed <= 0 {
+		return 0
+	}
+	return float64(p.Processed) / p.Elapsed.Seconds()
+}
+
+// BytesPerSecond returns the number of bytes read per second so far
+func (p Progress) BytesPerSecond() float64 {
+	if p.Elapsed <= 0 {
+		return 0
+	}
+	return float64(p.Bytes) / p.Elapsed.Seconds()
+}
+
+// ETA estimates the time left from the rate at which files have been
+// processed so far. It is only known once the walk has finished.
+func (p Progress) ETA() (time.Duration, bool) {
+	if !p.Walked || p.Processed == 0 {
+		return 0, false
+	}
+	if p.Processed >= p.Discovered {
+		return 0, true
+	}
+	remaining := float64(p.Discovered - p.Processed)
+	return time.Duration(float64(p.Elapsed) * remaining / float64(p.Processed)), true
+}
+
+// SetProgress makes IndexDirectory call fn with a snapshot of its progress
+// every interval while it runs, and once more with Done set when it ends.
+// fn is called from a single goroutine at a time. A nil fn turns reporting
+// off. It must not be called while the index is being updated.
+func (idx *Index) SetProgress(interval time.Duration, fn func(Progress)) {
+	idx.progressEvery = interval
+	idx.progress = fn
+}
+
+// snapshot returns the progress of the running IndexDirectory call
+func (idx *Index) snapshot(root string, start time.Time) Progress {
+	return Progress{
+		Root:       root,
+		Discovered: atomic.LoadUint64(&idx.discovered),
+		Processed:  atomic.LoadUint64(&idx.processed),
+		Indexed:    atomic.LoadUint64(&idx.indexed),
+		Bytes:      atomic.LoadUint64(&idx.bytesRead),
+		Elapsed:    time.Since(start),
+		Walked:     atomic.LoadUint32(&idx.walked) == 1,
+	}
+}
+
+// reportProgress starts calling the progress callback, if any, for an
+// IndexDirectory call started at start. The returned function stops the
+// reports and sends the final one; calling it more than once has no effect.
+func (idx *Index) reportProgress(root string, start time.Time) func() {
+	fn := idx.progress
+	if fn == nil {
+		return func() {}
+	}
+
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(idx.progressEvery)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				fn(idx.snapshot(root, start))
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(stop)
+			<-stopped
+			final := idx.snapshot(root, start)
+			final.Done = true
+			fn(final)
+		})
+	}
+}
+
+// queuePaths forwards paths from in to out, holding as many as needed so
+// that the walk, and with it the total for the ETA, is never held up by the
+// workers. out is closed once in is closed and every path has been sent.
+func queuePaths(in <-chan string, out chan<- string) {
+	defer close(out)
+	var queue []string
+	for in != nil || len(queue) > 0 {
+		// Sending on a nil channel blocks, so nothing is sent while the
+		// queue is empty
+		var send chan<- string
+		var next string
+		if len(queue) > 0 {
+			send, next = out, queue[0]
+		}
+		select {
+		case path, ok := <-in:
+			if !ok {
+				in = nil
+				continue
+			}
+			queue = append(queue, path)
+		case send <- next:
+			queue = queue[1:]
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package indexer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Change describes how Refresh changed the index
+type Change int
+
+const (
+	Unchanged Change = iota // The index already matched the file
+	Added                   // The file was added to the index
+	Updated                 // The file's entry was re-indexed
+	Removed                 // The file's entry, or the entries beneath a directory, were dropped
+)
+
+// String returns a lowercase name for the change
+func (c Change) String() string {
+	switch c {
+	case Added:
+		return "added"
+	case Updated:
+		return "updated"
+	case Removed:
+		return "removed"
+	}
+	return "unchanged"
+}
+
+// Refresh brings the index up to date for a single file that was created,
+// modified or deleted, applying the same rules as IndexDirectory. A path that
+// no longer exists drops its entry and every entry beneath it, which also
+// covers deleted and renamed directories. Files outside every indexed root
+// are left alone. Directories that still exist are not walked; callers should
+// index the containing root again to pick up their files.
+func (idx *Index) Refresh(path string) (Change, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return Unchanged, err
+	}
+	root, ok := idx.rootFor(path)
+	if !ok {
+		return Unchanged, nil
+	}
+
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		if idx.removeWithin(path) > 0 {
+			return Removed, nil
+		}
+		return Unchanged, nil
+	}
+	if err != nil {
+		return Unchanged, err
+	}
+	if info.IsDir() {
+		return Unchanged, fmt.Errorf("%s is a directory", path)
+	}
+
+	entry, existed := idx.GetFile(path)
+	if reason := walkReason(path, info, root); reason != "" {
+		if existed && idx.removeWithin(path) > 0 {
+			return Removed, nil
+		}
+		return Unchanged, nil
+	}
+	if existed && entry.Modified == info.ModTime().Unix() && entry.Size == info.Size() {
+		return Unchanged, nil
+	}
+
+	// indexFile drops entries of files that turn out to be binary
+	if err := idx.indexFile(path); err != nil {
+		if _, ok := err.(*skipError); ok {
+			if existed {
+				return Removed, nil
+			}
+			return Unchanged, nil
+		}
+		return Unchanged, err
+	}
+	if existed {
+		return Updated, nil
+	}
+	return Added, nil
+}
+
+// removeWithin drops the entry for path and every entry beneath it,
+// returning how many were removed
+func (idx *Index) removeWithin(path string) int {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	removed := 0
+	for p := range idx.files {
+		if withinRoot(p, path) {
+			idx.removeLocked(p)
+			removed++
+		}
+	}
+	return removed
+}
@@ -0,0 +1,98 @@
+package indexer
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Root describes a directory that has been added to the index
+type Root struct {
+	Path      string    `json:"path"`
+	Files     int       `json:"files"`      // Number of indexed files under the root
+	IndexedAt time.Time `json:"indexed_at"` // When the root was last indexed
+}
+
+// withinRoot reports whether path is root itself or lies beneath it
+func withinRoot(path, root string) bool {
+	if path == root {
+		return true
+	}
+	if !strings.HasSuffix(root, string(os.PathSeparator)) {
+		root += string(os.PathSeparator)
+	}
+	return strings.HasPrefix(path, root)
+}
+
+// countWithinLocked counts the files beneath root. The caller must hold idx.mu.
+func (idx *Index) countWithinLocked(root string) int {
+	count := 0
+	for path := range idx.files {
+		if withinRoot(path, root) {
+			count++
+		}
+	}
+	return count
+}
+
+// AddRoot records a root, e.g. one loaded from the cache, without indexing it
+func (idx *Index) AddRoot(root Root) {
+	root.Path = filepath.Clean(root.Path)
+
+	idx.mu.Lock()
+	idx.roots[root.Path] = &root
+	idx.mu.Unlock()
+}
+
+// Roots returns the indexed roots sorted by path, with up to date file counts
+func (idx *Index) Roots() []Root {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	roots := make([]Root, 0, len(idx.roots))
+	for _, root := range idx.roots {
+		r := *root
+		r.Files = idx.countWithinLocked(r.Path)
+		roots = append(roots, r)
+	}
+	sort.Slice(roots, func(i, j int) bool {
+		return roots[i].Path < roots[j].Path
+	})
+	return roots
+}
+
+// Forget removes a root and every file beneath it that is not also covered
+// by another root. It returns the number of files removed and whether the
+// root was known.
+func (idx *Index) Forget(root string) (int, bool) {
+	root = filepath.Clean(root)
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if _, ok := idx.roots[root]; !ok {
+		return 0, false
+	}
+	delete(idx.roots, root)
+
+	removed := 0
+	for path := range idx.files {
+		if withinRoot(path, root) && !idx.coveredLocked(path) {
+			idx.removeLocked(path)
+			removed++
+		}
+	}
+	return removed, true
+}
+
+// coveredLocked reports whether any root contains path. The caller must hold idx.mu.
+func (idx *Index) coveredLocked(path string) bool {
+	for other := range idx.roots {
+		if withinRoot(path, other) {
+			return true
+		}
+	}
+	return false
+}
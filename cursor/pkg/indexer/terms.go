@@ -0,0 +1,256 @@
+package indexer
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Posting records a single occurrence of a term in an indexed file
+type Posting struct {
+	Path   string `json:"path"`
+	Line   int    `json:"line"`
+	Column int    `json:"column"` // 1-based byte offset of the term within the line
+}
+
+// gramSize is the length in bytes of the term substrings that Index.grams
+// maps to terms, so that finding the terms containing a keyword does not
+// scan the whole vocabulary
+const gramSize = 3
+
+// Token is a term extracted from a piece of text
+type Token struct {
+	Term   string
+	Column int // 1-based byte offset of the term within the text
+}
+
+// Tokenize splits text into lowercase terms made of letters, digits and underscores
+func Tokenize(text string) []Token {
+	var tokens []Token
+	start := -1
+	for i, r := range text {
+		if isTermRune(r) {
+			if start < 0 {
+				start = i
+			}
+			continue
+		}
+		if start >= 0 {
+			tokens = append(tokens, Token{Term: strings.ToLower(text[start:i]), Column: start + 1})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		tokens = append(tokens, Token{Term: strings.ToLower(text[start:]), Column: start + 1})
+	}
+	return tokens
+}
+
+// isTermRune reports whether r can be part of a term
+func isTermRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// buildPostings tokenizes every line of an entry and groups the occurrences by term
+func buildPostings(entry *FileEntry) map[string][]Posting {
+	postings := make(map[string][]Posting)
+	for lineNum, line := range entry.Lines() {
+		for _, tok := range Tokenize(line) {
+			postings[tok.Term] = append(postings[tok.Term], Posting{
+				Path:   entry.Path,
+				Line:   lineNum,
+				Column: tok.Column,
+			})
+		}
+	}
+	return postings
+}
+
+// storeLocked adds an entry and its postings to the index, replacing any
+// previous entry for the same path. The caller must hold idx.mu for writing.
+func (idx *Index) storeLocked(entry *FileEntry) {
+	idx.removeLocked(entry.Path)
+
+	length := 0
+	for term, list := range entry.postings {
+		byFile := idx.terms[term]
+		if byFile == nil {
+			byFile = make(map[string][]Posting)
+			idx.terms[term] = byFile
+			idx.addTermLocked(term)
+		}
+		byFile[entry.Path] = list
+		length += len(list)
+	}
+	idx.files[entry.Path] = entry
+	idx.lengths[entry.Path] = length
+	idx.totalLen += length
+}
+
+// removeLocked drops an entry and its postings from the index, touching
+// only the terms the file contains. The caller must hold idx.mu for writing.
+func (idx *Index) removeLocked(path string) {
+	entry, ok := idx.files[path]
+	if !ok {
+		return
+	}
+	for term := range entry.postings {
+		byFile := idx.terms[term]
+		delete(byFile, path)
+		if len(byFile) == 0 {
+			delete(idx.terms, term)
+			idx.removeTermLocked(term)
+		}
+	}
+	idx.totalLen -= idx.lengths[path]
+	delete(idx.lengths, path)
+	delete(idx.files, path)
+}
+
+// addTermLocked numbers a new term and adds it to the grams containing it.
+// The caller must hold idx.mu for writing.
+func (idx *Index) addTermLocked(term string) {
+	id := uint32(len(idx.termList))
+	idx.termIDs[term] = id
+	idx.termList = append(idx.termList, term)
+	for i := 0; i+gramSize <= len(term); i++ {
+		gram := packGram(term[i:])
+		ids := idx.grams[gram]
+		// A gram repeated within the term lists it once
+		if len(ids) == 0 || ids[len(ids)-1] != id {
+			idx.grams[gram] = append(ids, id)
+		}
+	}
+}
+
+// removeTermLocked forgets a term that no file contains any more. Its
+// number stays in the grams until more terms are removed than remain, when
+// they are numbered again. The caller must hold idx.mu for writing.
+func (idx *Index) removeTermLocked(term string) {
+	idx.termList[idx.termIDs[term]] = ""
+	delete(idx.termIDs, term)
+	idx.deadTerms++
+	if idx.deadTerms <= len(idx.termIDs) {
+		return
+	}
+
+	idx.termIDs = make(map[string]uint32, len(idx.terms))
+	idx.termList = idx.termList[:0]
+	idx.grams = make(map[uint32][]uint32)
+	idx.deadTerms = 0
+	for term := range idx.terms {
+		idx.addTermLocked(term)
+	}
+}
+
+// packGram packs the first gramSize bytes of s into an integer
+func packGram(s string) uint32 {
+	return uint32(s[0])<<16 | uint32(s[1])<<8 | uint32(s[2])
+}
+
+// AddEntry adds a previously indexed entry (e.g. one loaded from the cache)
+// to the index and makes its content searchable
+func (idx *Index) AddEntry(entry *FileEntry) {
+	idx.mu.Lock()
+	idx.storeLocked(entry)
+	idx.mu.Unlock()
+}
+
+// Lookup returns every posting for an exact term, grouped by file
+func (idx *Index) Lookup(term string) []Posting {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	byFile := idx.terms[strings.ToLower(term)]
+	count := 0
+	for _, list := range byFile {
+		count += len(list)
+	}
+	postings := make([]Posting, 0, count)
+	for _, list := range byFile {
+		postings = append(postings, list...)
+	}
+	return postings
+}
+
+// TermsContaining returns all indexed terms that contain substr. Terms are
+// found through their substrings of gramSize bytes, so only substrings
+// shorter than that are checked against every indexed term.
+func (idx *Index) TermsContaining(substr string) []string {
+	substr = strings.ToLower(substr)
+	if substr == "" {
+		return nil
+	}
+
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	var terms []string
+	if len(substr) < gramSize {
+		for term := range idx.terms {
+			if strings.Contains(term, substr) {
+				terms = append(terms, term)
+			}
+		}
+		return terms
+	}
+
+	// Every term containing substr contains each of its grams, so check the
+	// terms of the rarest one
+	var rarest []uint32
+	for i := 0; i+gramSize <= len(substr); i++ {
+		ids, ok := idx.grams[packGram(substr[i:])]
+		if !ok {
+			return nil
+		}
+		if rarest == nil || len(ids) < len(rarest) {
+			rarest = ids
+		}
+	}
+	for _, id := range rarest {
+		// Removed terms are empty, which substr is not
+		if term := idx.termList[id]; strings.Contains(term, substr) {
+			terms = append(terms, term)
+		}
+	}
+	return terms
+}
+
+// DocFreq returns the number of files containing an exact term
+func (idx *Index) DocFreq(term string) int {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	return len(idx.terms[strings.ToLower(term)])
+}
+
+// FilesContaining returns the entries of the files that contain at least
+// one of the exact terms
+func (idx *Index) FilesContaining(terms []string) map[string]*FileEntry {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	files := make(map[string]*FileEntry)
+	for _, term := range terms {
+		for path := range idx.terms[strings.ToLower(term)] {
+			files[path] = idx.files[path]
+		}
+	}
+	return files
+}
+
+// DocLength returns the number of terms in an indexed file
+func (idx *Index) DocLength(path string) int {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	return idx.lengths[path]
+}
+
+// AverageDocLength returns the mean number of terms per indexed file
+func (idx *Index) AverageDocLength() float64 {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	if len(idx.files) == 0 {
+		return 0
+	}
+	return float64(idx.totalLen) / float64(len(idx.files))
+}
@@ -0,0 +1,70 @@
+package indexer
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+)
+
+func TestTermsContaining(t *testing.T) {
+	idx := NewIndex(1)
+	idx.AddEntry(NewFileEntry("/a", "ServeHTTP serve server\nhandler_func", 0, 0))
+	idx.AddEntry(NewFileEntry("/b", "observer ab a\nStraße", 0, 0))
+
+	tests := []struct {
+		substr string
+		want   []string
+	}{
+		{"serve", []string{"observer", "serve", "servehttp", "server"}},
+		{"SERVE", []string{"observer", "serve", "servehttp", "server"}},
+		{"http", []string{"servehttp"}},
+		{"r_f", []string{"handler_func"}},
+		{"aß", []string{"straße"}},
+		{"ab", []string{"ab"}}, // Shorter than a gram
+		{"a", []string{"a", "ab", "handler_func", "straße"}},
+		{"xyz", nil},
+		{"", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.substr, func(t *testing.T) {
+			got := idx.TermsContaining(tt.substr)
+			slices.Sort(got)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("TermsContaining(%q) = %q, want %q", tt.substr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTermsContainingAfterRemoval(t *testing.T) {
+	idx := NewIndex(1)
+	idx.AddEntry(NewFileEntry("/keep", "shared keeper", 0, 0))
+	// Replacing files many times removes their old terms, which renumbers
+	// the remaining ones along the way
+	for i := range 10 {
+		idx.AddEntry(NewFileEntry("/churn", fmt.Sprintf("shared churn%d", i), 0, 0))
+	}
+
+	tests := []struct {
+		substr string
+		want   []string
+	}{
+		{"churn", []string{"churn9"}},
+		{"keep", []string{"keeper"}},
+		{"har", []string{"shared"}},
+	}
+	for _, tt := range tests {
+		got := idx.TermsContaining(tt.substr)
+		slices.Sort(got)
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("TermsContaining(%q) = %q, want %q", tt.substr, got, tt.want)
+		}
+	}
+
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	if idx.deadTerms > len(idx.termIDs) {
+		t.Errorf("%d removed terms are still numbered alongside %d live ones", idx.deadTerms, len(idx.termIDs))
+	}
+}
@@ -0,0 +1,361 @@
+package query
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"indexer/pkg/indexer"
+	"indexer/pkg/search"
+)
+
+// Scope controls the granularity at which boolean operators combine matches
+type Scope int
+
+const (
+	// FileScope combines whole files: "foo AND bar" matches files containing
+	// both words, possibly on different lines
+	FileScope Scope = iota
+	// LineScope combines individual lines: "foo AND bar" matches lines
+	// containing both words
+	LineScope
+)
+
+// ParseScope converts "file" or "line" to a Scope
+func ParseScope(s string) (Scope, error) {
+	switch strings.ToLower(s) {
+	case "file":
+		return FileScope, nil
+	case "line":
+		return LineScope, nil
+	default:
+		return FileScope, fmt.Errorf("unknown scope %q (expected file or line)", s)
+	}
+}
+
+// String returns the name accepted by ParseScope
+func (s Scope) String() string {
+	if s == LineScope {
+		return "line"
+	}
+	return "file"
+}
+
+// fileHits maps each matching file to its matching lines. A file can match
+// without any lines, e.g. through a field qualifier or a negation.
+type fileHits map[string]map[int]search.SearchResult
+
+// evaluator evaluates a query against a single index
+type evaluator struct {
+	ctx      context.Context
+	idx      *indexer.Index
+	jobs     int                       // workers for every text term search
+	universe []string                  // every indexed path, loaded on first use
+	patterns map[string]*regexp.Regexp // compiled text terms, for line scope
+}
+
+// Evaluate runs a parsed query against the index. Text terms are answered
+// with search.Search; field qualifiers and negations apply to whole files.
+// Files that match without any matching line are reported with line 0.
+// Each search uses jobs workers, or runtime.NumCPU() if jobs is not positive.
+func Evaluate(idx *indexer.Index, node Node, scope Scope, jobs int) []search.SearchResult {
+	results, _ := EvaluateContext(context.Background(), idx, node, scope, jobs)
+	return results
+}
+
+// EvaluateContext is like Evaluate but gives up once ctx is done, returning its error
+func EvaluateContext(ctx context.Context, idx *indexer.Index, node Node, scope Scope, jobs int) ([]search.SearchResult, error) {
+	ev := &evaluator{ctx: ctx, idx: idx, jobs: jobs}
+
+	var hits fileHits
+	if scope == LineScope && len(PositiveTerms(node)) > 0 {
+		hits = ev.evalLines(node)
+	} else {
+		hits = ev.evalFiles(node, false)
+	}
+	// Searches cut short by ctx leave the hits incomplete
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return hits.results(), nil
+}
+
+// PositiveTerms returns the text terms a match can be credited to, i.e.
+// those not under a negation
+func PositiveTerms(node Node) []string {
+	switch n := node.(type) {
+	case *Term:
+		return []string{n.Text}
+	case *And:
+		return childTerms(n.Children)
+	case *Or:
+		return childTerms(n.Children)
+	}
+	return nil
+}
+
+// childTerms collects the positive terms of several nodes
+func childTerms(children []Node) []string {
+	var terms []string
+	for _, child := range children {
+		terms = append(terms, PositiveTerms(child)...)
+	}
+	return terms
+}
+
+// allFiles returns every indexed path
+func (ev *evaluator) allFiles() []string {
+	if ev.universe == nil {
+		files := ev.idx.GetFiles()
+		ev.universe = make([]string, 0, len(files))
+		for path := range files {
+			ev.universe = append(ev.universe, path)
+		}
+	}
+	return ev.universe
+}
+
+// evalFiles evaluates a node at file scope. When relaxed is set, negations
+// are treated as always true, which yields a superset of the real matches
+// that line scope evaluation then narrows down.
+func (ev *evaluator) evalFiles(node Node, relaxed bool) fileHits {
+	switch n := node.(type) {
+	case *Term:
+		hits := make(fileHits)
+		results, _ := search.SearchContext(ev.ctx, ev.idx, n.Text, ev.jobs)
+		for _, result := range results {
+			hits.add(result)
+		}
+		return hits
+
+	case *Field:
+		hits := make(fileHits)
+		for _, path := range ev.allFiles() {
+			if n.matches(path) {
+				hits[path] = make(map[int]search.SearchResult)
+			}
+		}
+		return hits
+
+	case *Not:
+		hits := make(fileHits)
+		var excluded fileHits
+		if !relaxed {
+			excluded = ev.evalFiles(n.Child, relaxed)
+		}
+		for _, path := range ev.allFiles() {
+			if _, ok := excluded[path]; !ok {
+				hits[path] = make(map[int]search.SearchResult)
+			}
+		}
+		return hits
+
+	case *And:
+		// Evaluate positive children first and apply negations as filters,
+		// so that a negation never has to enumerate every indexed file
+		var hits fileHits
+		var negations []*Not
+		for _, child := range n.Children {
+			if not, ok := child.(*Not); ok {
+				negations = append(negations, not)
+				continue
+			}
+			childHits := ev.evalFiles(child, relaxed)
+			if hits == nil {
+				hits = childHits
+			} else {
+				hits = hits.intersect(childHits)
+			}
+		}
+		if hits == nil {
+			hits = ev.evalFiles(negations[0], relaxed)
+			negations = negations[1:]
+		}
+		if !relaxed {
+			for _, not := range negations {
+				for path := range ev.evalFiles(not.Child, relaxed) {
+					delete(hits, path)
+				}
+			}
+		}
+		return hits
+
+	case *Or:
+		hits := make(fileHits)
+		for _, child := range n.Children {
+			hits.union(ev.evalFiles(child, relaxed))
+		}
+		return hits
+	}
+	return make(fileHits)
+}
+
+// evalLines evaluates a node at line scope. Candidate files come from a
+// relaxed file scope evaluation; every line of a candidate is then checked
+// against the query, and matching lines are reported with the spans of the
+// positive terms they contain. A line can match without any, e.g. through a
+// field qualifier in an OR.
+func (ev *evaluator) evalLines(node Node) fileHits {
+	terms := PositiveTerms(node)
+	hits := make(fileHits)
+
+	for path := range ev.evalFiles(node, true) {
+		if ev.ctx.Err() != nil {
+			break
+		}
+		entry, ok := ev.idx.GetFile(path)
+		if !ok {
+			continue
+		}
+		for lineNum, line := range entry.Lines() {
+			if !ev.matchesLine(node, path, line) {
+				continue
+			}
+
+			var matches []search.Match
+			for _, term := range terms {
+				matches = append(matches, search.FindMatches(line, ev.pattern(term))...)
+			}
+			hits.add(search.SearchResult{
+				FilePath:   path,
+				LineNumber: lineNum,
+				Line:       line,
+				MatchCount: len(matches),
+				Matches:    matches,
+			})
+		}
+	}
+	return hits
+}
+
+// pattern returns the compiled pattern of a text term
+func (ev *evaluator) pattern(text string) *regexp.Regexp {
+	re, ok := ev.patterns[text]
+	if !ok {
+		if ev.patterns == nil {
+			ev.patterns = make(map[string]*regexp.Regexp)
+		}
+		re = search.KeywordPattern(text)
+		ev.patterns[text] = re
+	}
+	return re
+}
+
+// matchesLine evaluates a node against a single line of a file
+func (ev *evaluator) matchesLine(node Node, path, line string) bool {
+	switch n := node.(type) {
+	case *Term:
+		return ev.pattern(n.Text).MatchString(line)
+	case *Field:
+		return n.matches(path)
+	case *Not:
+		return !ev.matchesLine(n.Child, path, line)
+	case *And:
+		for _, child := range n.Children {
+			if !ev.matchesLine(child, path, line) {
+				return false
+			}
+		}
+		return true
+	case *Or:
+		for _, child := range n.Children {
+			if ev.matchesLine(child, path, line) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matches reports whether a file path satisfies the field qualifier
+func (f *Field) matches(path string) bool {
+	switch f.Name {
+	case "path":
+		return strings.Contains(strings.ToLower(filepath.ToSlash(path)), strings.ToLower(f.Value))
+	case "ext":
+		ext := strings.TrimPrefix(filepath.Ext(path), ".")
+		return strings.EqualFold(ext, strings.TrimPrefix(f.Value, "."))
+	}
+	return false
+}
+
+// add records a matching line, merging it with an existing result for the same line
+func (h fileHits) add(result search.SearchResult) {
+	lines, ok := h[result.FilePath]
+	if !ok {
+		lines = make(map[int]search.SearchResult)
+		h[result.FilePath] = lines
+	}
+	if existing, ok := lines[result.LineNumber]; ok {
+		result = mergeResults(existing, result)
+	}
+	lines[result.LineNumber] = result
+}
+
+// union adds every file and line of other to h
+func (h fileHits) union(other fileHits) {
+	for path, lines := range other {
+		if _, ok := h[path]; !ok {
+			h[path] = make(map[int]search.SearchResult)
+		}
+		for _, result := range lines {
+			h.add(result)
+		}
+	}
+}
+
+// intersect keeps the files present in both sets, with the lines of both
+func (h fileHits) intersect(other fileHits) fileHits {
+	out := make(fileHits)
+	for path, lines := range h {
+		otherLines, ok := other[path]
+		if !ok {
+			continue
+		}
+		out[path] = make(map[int]search.SearchResult)
+		for _, result := range lines {
+			out.add(result)
+		}
+		for _, result := range otherLines {
+			out.add(result)
+		}
+	}
+	return out
+}
+
+// results flattens the hits into search results
+func (h fileHits) results() []search.SearchResult {
+	results := make([]search.SearchResult, 0, len(h))
+	for path, lines := range h {
+		if len(lines) == 0 {
+			results = append(results, search.SearchResult{FilePath: path})
+			continue
+		}
+		for _, result := range lines {
+			results = append(results, result)
+		}
+	}
+	return results
+}
+
+// mergeResults combines two results for the same line, keeping each match span once
+func mergeResults(a, b search.SearchResult) search.SearchResult {
+	seen := make(map[search.Match]bool)
+	var matches []search.Match
+	for _, m := range append(append([]search.Match{}, a.Matches...), b.Matches...) {
+		if !seen[m] {
+			seen[m] = true
+			matches = append(matches, m)
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i].Column < matches[j].Column
+	})
+
+	a.Matches = matches
+	a.MatchCount = len(matches)
+	return a
+}
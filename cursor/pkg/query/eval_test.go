@@ -0,0 +1,104 @@
+package query
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+
+	"indexer/pkg/indexer"
+)
+
+// testIndex builds an index holding the given files
+func testIndex(files map[string]string) *indexer.Index {
+	idx := indexer.NewIndex(1)
+	for path, content := range files {
+		idx.AddEntry(indexer.NewFileEntry(path, content, 0, int64(len(content))))
+	}
+	return idx
+}
+
+func TestEvaluateScope(t *testing.T) {
+	idx := testIndex(map[string]string{
+		"/src/a.go":     "foo\nbar\n",
+		"/src/b.go":     "foo bar\n",
+		"/docs/c.md":    "foo\n",
+		"/my docs/d.md": "baz\n",
+	})
+
+	tests := []struct {
+		query string
+		file  []string // Matches at file scope, as path:line
+		line  []string // Matches at line scope
+	}{
+		{
+			query: "foo bar",
+			file:  []string{"/src/a.go:1", "/src/a.go:2", "/src/b.go:1"},
+			line:  []string{"/src/b.go:1"},
+		},
+		{
+			query: "foo OR baz",
+			file:  []string{"/docs/c.md:1", "/my docs/d.md:1", "/src/a.go:1", "/src/b.go:1"},
+			line:  []string{"/docs/c.md:1", "/my docs/d.md:1", "/src/a.go:1", "/src/b.go:1"},
+		},
+		{
+			query: "foo -bar",
+			file:  []string{"/docs/c.md:1"},
+			line:  []string{"/docs/c.md:1", "/src/a.go:1"},
+		},
+		{
+			query: "foo -(bar OR ext:md)",
+			file:  nil,
+			line:  []string{"/src/a.go:1"},
+		},
+		{
+			query: `"foo bar"`,
+			file:  []string{"/src/b.go:1"},
+			line:  []string{"/src/b.go:1"},
+		},
+		{
+			// Lines match through the field even without the term
+			query: "foo OR ext:go",
+			file:  []string{"/docs/c.md:1", "/src/a.go:1", "/src/b.go:1"},
+			line:  []string{"/docs/c.md:1", "/src/a.go:1", "/src/a.go:2", "/src/b.go:1"},
+		},
+		{
+			query: "foo ext:md",
+			file:  []string{"/docs/c.md:1"},
+			line:  []string{"/docs/c.md:1"},
+		},
+		{
+			query: `path:"my docs" OR bar`,
+			file:  []string{"/my docs/d.md:0", "/src/a.go:2", "/src/b.go:1"},
+			line:  []string{"/my docs/d.md:1", "/src/a.go:2", "/src/b.go:1"},
+		},
+		{
+			// Without positive terms line scope falls back to file scope
+			query: "-foo",
+			file:  []string{"/my docs/d.md:0"},
+			line:  []string{"/my docs/d.md:0"},
+		},
+	}
+
+	for _, tt := range tests {
+		node, err := Parse(tt.query)
+		if err != nil {
+			t.Fatalf("Parse(%q) failed: %v", tt.query, err)
+		}
+		for _, scope := range []Scope{FileScope, LineScope} {
+			t.Run(fmt.Sprintf("%s/%s", tt.query, scope), func(t *testing.T) {
+				want := tt.file
+				if scope == LineScope {
+					want = tt.line
+				}
+				var got []string
+				for _, result := range Evaluate(idx, node, scope, 1) {
+					got = append(got, fmt.Sprintf("%s:%d", result.FilePath, result.LineNumber))
+				}
+				slices.Sort(got)
+				if !slices.Equal(got, want) {
+					t.Errorf("Evaluate(%q) = %v, want %v", tt.query, got, want)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,329 @@
+package query
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Node is an element of a parsed query
+type Node interface {
+	String() string
+}
+
+// Term matches lines containing a word or, when Phrase is set, an exact phrase
+type Term struct {
+	Text   string
+	Phrase bool
+}
+
+// Field restricts matches to files whose path or extension matches a value
+type Field struct {
+	Name  string // "path" or "ext"
+	Value string
+}
+
+// And matches when every child matches
+type And struct {
+	Children []Node
+}
+
+// Or matches when any child matches
+type Or struct {
+	Children []Node
+}
+
+// Not matches when its child does not
+type Not struct {
+	Child Node
+}
+
+func (t *Term) String() string {
+	if t.Phrase {
+		return fmt.Sprintf("%q", t.Text)
+	}
+	return t.Text
+}
+
+func (f *Field) String() string { return f.Name + ":" + f.Value }
+
+func (a *And) String() string { return joinNodes(a.Children, " AND ") }
+
+func (o *Or) String() string { return joinNodes(o.Children, " OR ") }
+
+func (n *Not) String() string { return "-" + n.Child.String() }
+
+// joinNodes renders children separated by an operator and wrapped in parentheses
+func joinNodes(children []Node, op string) string {
+	parts := make([]string, len(children))
+	for i, child := range children {
+		parts[i] = child.String()
+	}
+	return "(" + strings.Join(parts, op) + ")"
+}
+
+// fields lists the supported field qualifiers
+var fields = map[string]bool{
+	"path": true,
+	"ext":  true,
+}
+
+// tokenKind identifies the type of a lexical token
+type tokenKind int
+
+const (
+	tokWord tokenKind = iota
+	tokPhrase
+	tokField
+	tokAnd
+	tokOr
+	tokNot
+	tokLParen
+	tokRParen
+	tokEOF
+)
+
+// token is a lexical element of a query
+type token struct {
+	kind  tokenKind
+	text  string // word or phrase text, or the field value
+	field string // field name for tokField
+	pos   int    // byte offset in the query, for error messages
+}
+
+// lex splits a query into tokens
+func lex(input string) ([]token, error) {
+	var tokens []token
+	i := 0
+	for i < len(input) {
+		c := input[i]
+		switch {
+		case unicode.IsSpace(rune(c)):
+			i++
+		case c == '(':
+			tokens = append(tokens, token{kind: tokLParen, pos: i})
+			i++
+		case c == ')':
+			tokens = append(tokens, token{kind: tokRParen, pos: i})
+			i++
+		case c == '-':
+			tokens = append(tokens, token{kind: tokNot, pos: i})
+			i++
+		case c == '"':
+			text, next, err := readQuoted(input, i)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, token{kind: tokPhrase, text: text, pos: i})
+			i = next
+		default:
+			start := i
+			for i < len(input) && !isDelimiter(input[i]) {
+				i++
+			}
+			word := input[start:i]
+
+			switch word {
+			case "AND":
+				tokens = append(tokens, token{kind: tokAnd, pos: start})
+				continue
+			case "OR":
+				tokens = append(tokens, token{kind: tokOr, pos: start})
+				continue
+			case "NOT":
+				tokens = append(tokens, token{kind: tokNot, pos: start})
+				continue
+			}
+
+			// A known qualifier followed by a colon starts a field; its
+			// value may be quoted to include spaces
+			if name, value, ok := strings.Cut(word, ":"); ok && fields[strings.ToLower(name)] {
+				if value == "" && i < len(input) && input[i] == '"' {
+					quoted, next, err := readQuoted(input, i)
+					if err != nil {
+						return nil, err
+					}
+					value = quoted
+					i = next
+				}
+				if value == "" {
+					return nil, fmt.Errorf("missing value for %s: at position %d", name, start+1)
+				}
+				tokens = append(tokens, token{kind: tokField, field: strings.ToLower(name), text: value, pos: start})
+				continue
+			}
+
+			tokens = append(tokens, token{kind: tokWord, text: word, pos: start})
+		}
+	}
+	return append(tokens, token{kind: tokEOF, pos: len(input)}), nil
+}
+
+// isDelimiter reports whether c ends a bare word
+func isDelimiter(c byte) bool {
+	return c == '(' || c == ')' || c == '"' || unicode.IsSpace(rune(c))
+}
+
+// readQuoted reads a double-quoted string starting at input[start] and
+// returns its content and the offset just past the closing quote
+func readQuoted(input string, start int) (string, int, error) {
+	end := strings.IndexByte(input[start+1:], '"')
+	if end < 0 {
+		return "", 0, fmt.Errorf("unterminated quote at position %d", start+1)
+	}
+	return input[start+1 : start+1+end], start + end + 2, nil
+}
+
+// parser builds an AST from tokens using recursive descent:
+//
+//	query   = or
+//	or      = and { "OR" and }
+//	and     = unary { ["AND"] unary }
+//	unary   = ( "-" | "NOT" ) unary | primary
+//	primary = "(" or ")" | phrase | field | word
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+// Parse parses a query string into an AST
+func Parse(input string) (Node, error) {
+	tokens, err := lex(input)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens}
+	if p.peek().kind == tokEOF {
+		return nil, fmt.Errorf("empty query")
+	}
+
+	node, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokEOF {
+		return nil, fmt.Errorf("unexpected %s at position %d", describe(tok), tok.pos+1)
+	}
+	return node, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *parser) parseOr() (Node, error) {
+	node, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	children := []Node{node}
+	for p.peek().kind == tokOr {
+		p.next()
+		node, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, node)
+	}
+
+	if len(children) == 1 {
+		return children[0], nil
+	}
+	return &Or{Children: children}, nil
+}
+
+func (p *parser) parseAnd() (Node, error) {
+	node, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	children := []Node{node}
+	for {
+		switch p.peek().kind {
+		case tokAnd:
+			p.next()
+		case tokWord, tokPhrase, tokField, tokNot, tokLParen:
+			// Adjacent terms are implicitly combined with AND
+		default:
+			if len(children) == 1 {
+				return children[0], nil
+			}
+			return &And{Children: children}, nil
+		}
+
+		node, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, node)
+	}
+}
+
+func (p *parser) parseUnary() (Node, error) {
+	if p.peek().kind == tokNot {
+		p.next()
+		child, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &Not{Child: child}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (Node, error) {
+	tok := p.next()
+	switch tok.kind {
+	case tokLParen:
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if closing := p.next(); closing.kind != tokRParen {
+			return nil, fmt.Errorf("expected ) at position %d, found %s", closing.pos+1, describe(closing))
+		}
+		return node, nil
+	case tokWord:
+		return &Term{Text: tok.text}, nil
+	case tokPhrase:
+		if tok.text == "" {
+			return nil, fmt.Errorf("empty phrase at position %d", tok.pos+1)
+		}
+		return &Term{Text: tok.text, Phrase: true}, nil
+	case tokField:
+		return &Field{Name: tok.field, Value: tok.text}, nil
+	default:
+		return nil, fmt.Errorf("unexpected %s at position %d", describe(tok), tok.pos+1)
+	}
+}
+
+// describe names a token for error messages
+func describe(tok token) string {
+	switch tok.kind {
+	case tokAnd:
+		return "AND"
+	case tokOr:
+		return "OR"
+	case tokNot:
+		return "negation"
+	case tokLParen:
+		return "("
+	case tokRParen:
+		return ")"
+	case tokEOF:
+		return "end of query"
+	default:
+		return fmt.Sprintf("%q", tok.text)
+	}
+}
@@ -0,0 +1,80 @@
+package query
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"single word", "foo", "foo"},
+		{"implicit and", "foo bar", "(foo AND bar)"},
+		{"explicit and", "foo AND bar", "(foo AND bar)"},
+		{"implicit and binds tighter than or", "foo bar OR baz", "((foo AND bar) OR baz)"},
+		{"or then implicit and", "foo OR bar baz", "(foo OR (bar AND baz))"},
+		{"mixed and or", "a AND b OR c d", "((a AND b) OR (c AND d))"},
+		{"parentheses override precedence", "(foo OR bar) baz", "((foo OR bar) AND baz)"},
+		{"lowercase operators are words", "foo or bar", "(foo AND or AND bar)"},
+		{"dash negation", "-foo", "-foo"},
+		{"not negation", "NOT foo", "-foo"},
+		{"double negation", "NOT -foo", "--foo"},
+		{"negated group", "-(foo OR bar)", "-(foo OR bar)"},
+		{"negation binds tighter than and", "NOT foo bar", "(-foo AND bar)"},
+		{"several negations", "foo -bar -baz", "(foo AND -bar AND -baz)"},
+		{"negation inside group", "foo (bar OR -baz)", "(foo AND (bar OR -baz))"},
+		{"phrase", `"foo bar" baz`, `("foo bar" AND baz)`},
+		{"field", "ext:go foo", "(ext:go AND foo)"},
+		{"field name is case insensitive", "PATH:src", "path:src"},
+		{"quoted field value", `path:"a b" x`, "(path:a b AND x)"},
+		{"unknown qualifier is a word", "foo:bar", "foo:bar"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node, err := Parse(tt.input)
+			if err != nil {
+				t.Fatalf("Parse(%q) failed: %v", tt.input, err)
+			}
+			if got := node.String(); got != tt.want {
+				t.Errorf("Parse(%q) = %s, want %s", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string // Part of the error message
+	}{
+		{"empty", "", "empty query"},
+		{"blank", "   ", "empty query"},
+		{"unterminated quote", `"foo`, "unterminated quote at position 1"},
+		{"unterminated quote after word", `foo "bar`, "unterminated quote at position 5"},
+		{"unterminated field value", `path:"a b`, "unterminated quote at position 6"},
+		{"missing field value", "ext:", "missing value for ext"},
+		{"empty phrase", `foo ""`, "empty phrase at position 5"},
+		{"trailing or", "foo OR", "unexpected end of query"},
+		{"leading and", "AND foo", "unexpected AND at position 1"},
+		{"dangling negation", "foo -", "unexpected end of query"},
+		{"unclosed group", "(foo", "expected ) at position 5"},
+		{"unopened group", "foo)", "unexpected ) at position 4"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node, err := Parse(tt.input)
+			if err == nil {
+				t.Fatalf("Parse(%q) = %s, want an error", tt.input, node)
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Parse(%q) error = %q, want it to contain %q", tt.input, err, tt.want)
+			}
+		})
+	}
+}
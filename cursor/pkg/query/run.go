@@ -0,0 +1,114 @@
+package query
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"indexer/pkg/indexer"
+	"indexer/pkg/search"
+)
+
+// Mode selects how search text is interpreted
+type Mode int
+
+const (
+	KeywordMode Mode = iota // A plain keyword, matched as a substring
+	RegexMode               // A regular expression
+	QueryMode               // A boolean query
+)
+
+// ParseMode converts "keyword", "regex" or "query" to a Mode
+func ParseMode(s string) (Mode, error) {
+	switch strings.ToLower(s) {
+	case "", "keyword":
+		return KeywordMode, nil
+	case "regex":
+		return RegexMode, nil
+	case "query":
+		return QueryMode, nil
+	default:
+		return KeywordMode, fmt.Errorf("unknown mode %q (expected keyword, regex or query)", s)
+	}
+}
+
+// String returns the name accepted by ParseMode
+func (m Mode) String() string {
+	switch m {
+	case RegexMode:
+		return "regex"
+	case QueryMode:
+		return "query"
+	}
+	return "keyword"
+}
+
+// Options controls how Run interprets and orders a search
+type Options struct {
+	Mode  Mode
+	Scope Scope // Only used in QueryMode
+	Rank  bool  // Order files by BM25 relevance instead of by path
+	Jobs  int   // Search workers, or runtime.NumCPU() if not positive
+}
+
+// Run searches the index for text interpreted according to opts. Results
+// are sorted by path and line, or by relevance with the best file first when
+// ranking.
+func Run(idx *indexer.Index, text string, opts Options) ([]search.SearchResult, error) {
+	return RunContext(context.Background(), idx, text, opts)
+}
+
+// RunContext is like Run but gives up once ctx is done, returning its error
+func RunContext(ctx context.Context, idx *indexer.Index, text string, opts Options) ([]search.SearchResult, error) {
+	var results []search.SearchResult
+	var err error
+	// Results per query term, used for ranking
+	hits := make(map[string][]search.SearchResult)
+
+	switch opts.Mode {
+	case RegexMode:
+		results, err = search.RegexContext(ctx, idx, text, opts.Jobs)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, fmt.Errorf("invalid regular expression: %w", err)
+		}
+		hits[text] = results
+	case QueryMode:
+		node, err := Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid query: %w", err)
+		}
+		if results, err = EvaluateContext(ctx, idx, node, opts.Scope, opts.Jobs); err != nil {
+			return nil, err
+		}
+		if opts.Rank {
+			for _, term := range PositiveTerms(node) {
+				if _, ok := hits[term]; !ok {
+					if hits[term], err = search.SearchContext(ctx, idx, term, opts.Jobs); err != nil {
+						return nil, err
+					}
+				}
+			}
+		}
+	default:
+		if results, err = search.SearchContext(ctx, idx, text, opts.Jobs); err != nil {
+			return nil, err
+		}
+		hits[text] = results
+	}
+
+	if opts.Rank {
+		search.Rank(results, search.Score(idx, hits))
+	} else {
+		sort.Slice(results, func(i, j int) bool {
+			if results[i].FilePath == results[j].FilePath {
+				return results[i].LineNumber < results[j].LineNumber
+			}
+			return results[i].FilePath < results[j].FilePath
+		})
+	}
+	return results, nil
+}
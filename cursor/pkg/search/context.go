@@ -0,0 +1,99 @@
+package search
+
+import (
+	"sort"
+
+	"indexer/pkg/indexer"
+)
+
+// ContextLine is a line of a block, either a matching line or one of its neighbours
+type ContextLine struct {
+	LineNumber int     `json:"line_number"`
+	Line       string  `json:"line"`
+	Match      bool    `json:"match"`             // False for context lines
+	Matches    []Match `json:"matches,omitempty"` // Column spans on matching lines
+}
+
+// Block is a run of consecutive lines of a file around one or more matches
+type Block struct {
+	FilePath string        `json:"file_path"`
+	Score    float64       `json:"score,omitempty"`
+	Lines    []ContextLine `json:"lines"`
+}
+
+// WithContext groups results into blocks that include up to before lines
+// preceding and after lines following each matching line, read from the
+// stored file content. Windows that overlap or touch are merged into a single
+// block. Files keep the order in which they first appear in results.
+func WithContext(idx *indexer.Index, results []SearchResult, before, after int) []Block {
+	var order []string
+	byFile := make(map[string][]SearchResult)
+	for _, result := range results {
+		if _, ok := byFile[result.FilePath]; !ok {
+			order = append(order, result.FilePath)
+		}
+		byFile[result.FilePath] = append(byFile[result.FilePath], result)
+	}
+
+	var blocks []Block
+	for _, path := range order {
+		fileResults := byFile[path]
+		sort.Slice(fileResults, func(i, j int) bool {
+			return fileResults[i].LineNumber < fileResults[j].LineNumber
+		})
+
+		entry, ok := idx.GetFile(path)
+		if !ok {
+			continue
+		}
+		blocks = append(blocks, fileBlocks(entry, fileResults, before, after)...)
+	}
+	return blocks
+}
+
+// fileBlocks builds the blocks of a single file from its results sorted by line
+func fileBlocks(entry *indexer.FileEntry, results []SearchResult, before, after int) []Block {
+	score := results[0].Score
+	lineCount := entry.LineCount()
+
+	var blocks []Block
+	var current *Block
+	last := 0 // Last line number added to the current block
+
+	for _, result := range results {
+		// Files matched without any line produce an empty block
+		if result.LineNumber == 0 {
+			blocks = append(blocks, Block{FilePath: entry.Path, Score: score})
+			current = nil
+			continue
+		}
+
+		start := max(result.LineNumber-before, 1)
+		end := min(result.LineNumber+after, lineCount)
+
+		// Start a new block unless this window overlaps or touches the current one
+		if current == nil || start > last+1 {
+			blocks = append(blocks, Block{FilePath: entry.Path, Score: score})
+			current = &blocks[len(blocks)-1]
+			last = start - 1
+		}
+
+		for n := last + 1; n <= end; n++ {
+			current.Lines = append(current.Lines, ContextLine{
+				LineNumber: n,
+				Line:       entry.Line(n),
+			})
+		}
+		last = max(last, end)
+
+		// Mark the matching line, which is already part of the block
+		if len(current.Lines) == 0 {
+			continue
+		}
+		if i := result.LineNumber - current.Lines[0].LineNumber; i >= 0 && i < len(current.Lines) {
+			current.Lines[i].Match = true
+			current.Lines[i].Matches = result.Matches
+		}
+	}
+	return blocks
+}
@@ -0,0 +1,61 @@
+package search
+
+import (
+	"context"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// searchFiles runs search over every item with a fixed number of workers,
+// jobs or runtime.NumCPU() if jobs is not positive. Workers take the next
+// item as they finish one and append matches to a batch of their own, and
+// the batches are concatenated once every worker is done. Workers stop
+// taking items once ctx is done, and its error is returned instead.
+func searchFiles[T any](ctx context.Context, items []T, jobs int, search func(item T, batch []SearchResult) []SearchResult) ([]SearchResult, error) {
+	if jobs < 1 {
+		jobs = runtime.NumCPU()
+	}
+	jobs = min(jobs, len(items))
+
+	batches := make([][]SearchResult, jobs)
+	var next int64 = -1
+	var wg sync.WaitGroup
+	for w := range batches {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				i := atomic.AddInt64(&next, 1)
+				if i >= int64(len(items)) || ctx.Err() != nil {
+					return
+				}
+				batches[w] = search(items[i], batches[w])
+			}
+		}()
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	total := 0
+	for _, batch := range batches {
+		total += len(batch)
+	}
+	results := make([]SearchResult, 0, total)
+	for _, batch := range batches {
+		results = append(results, batch...)
+	}
+	return results, nil
+}
+
+// summarize counts the matches and distinct files of a set of results
+func summarize(results []SearchResult) (matches, files int) {
+	seen := make(map[string]bool)
+	for _, result := range results {
+		matches += result.MatchCount
+		seen[result.FilePath] = true
+	}
+	return matches, len(seen)
+}
@@ -0,0 +1,64 @@
+package search
+
+import (
+	"math"
+	"sort"
+
+	"indexer/pkg/indexer"
+)
+
+// BM25 tuning parameters
+const (
+	bm25K1 = 1.2  // Term frequency saturation
+	bm25B  = 0.75 // Strength of file length normalisation
+)
+
+// Score computes a BM25 relevance score for every file with results. hits
+// maps each query term to the results it produced: a file's term frequency
+// is its total match count for the term, and the term's document frequency
+// is the number of files it matched in.
+func Score(idx *indexer.Index, hits map[string][]SearchResult) map[string]float64 {
+	scores := make(map[string]float64)
+
+	total := float64(idx.FileCount())
+	avgLen := idx.AverageDocLength()
+	if total == 0 || avgLen == 0 {
+		return scores
+	}
+
+	for _, results := range hits {
+		freqs := make(map[string]int)
+		for _, result := range results {
+			freqs[result.FilePath] += result.MatchCount
+		}
+
+		df := float64(len(freqs))
+		idf := math.Log(1 + (total-df+0.5)/(df+0.5))
+
+		for path, freq := range freqs {
+			tf := float64(freq)
+			norm := 1 - bm25B + bm25B*float64(idx.DocLength(path))/avgLen
+			scores[path] += idf * tf * (bm25K1 + 1) / (tf + bm25K1*norm)
+		}
+	}
+	return scores
+}
+
+// Rank sets the score of every result from its file's score and orders the
+// results best file first, then by path and line number
+func Rank(results []SearchResult, scores map[string]float64) {
+	for i := range results {
+		results[i].Score = scores[results[i].FilePath]
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		if a.Score != b.Score {
+			return a.Score > b.Score
+		}
+		if a.FilePath != b.FilePath {
+			return a.FilePath < b.FilePath
+		}
+		return a.LineNumber < b.LineNumber
+	})
+}
@@ -0,0 +1,106 @@
+package search
+
+import (
+	"context"
+	"log/slog"
+	"regexp"
+	"regexp/syntax"
+
+	"indexer/pkg/indexer"
+)
+
+// Regex searches every indexed line for matches of a regular expression with
+// jobs workers, or runtime.NumCPU() if jobs is not positive. Literal
+// substrings that any match must contain are looked up in the term index
+// first, so only files that can possibly match are scanned.
+func Regex(idx *indexer.Index, pattern string, jobs int) ([]SearchResult, error) {
+	return RegexContext(context.Background(), idx, pattern, jobs)
+}
+
+// RegexContext is like Regex but gives up once ctx is done, returning its error
+func RegexContext(ctx context.Context, idx *indexer.Index, pattern string, jobs int) ([]SearchResult, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	parsed, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return nil, err
+	}
+	candidates := candidateFiles(idx, requiredLiterals(parsed.Simplify()))
+	slog.Debug("searching", "candidates", len(candidates), "files", idx.FileCount())
+
+	tasks := make([]fileTask, 0, len(candidates))
+	for path, entry := range candidates {
+		tasks = append(tasks, fileTask{path: path, entry: entry})
+	}
+	results, err := searchFiles(ctx, tasks, jobs, func(task fileTask, batch []SearchResult) []SearchResult {
+		return regexFile(task.path, task.entry, re, batch)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	matchCount, fileCount := summarize(results)
+	slog.Debug("search complete", "matches", matchCount, "files", fileCount)
+	return results, nil
+}
+
+// regexFile appends every line of a file that matches the expression to results
+func regexFile(path string, entry *indexer.FileEntry, re *regexp.Regexp, results []SearchResult) []SearchResult {
+	for lineNum, line := range entry.Lines() {
+		results = matchLine(path, lineNum, line, re, results)
+	}
+	return results
+}
+
+// requiredLiterals returns literal strings that every match of the
+// expression must contain. Alternations and optional parts contribute
+// nothing, so the result may be empty.
+func requiredLiterals(re *syntax.Regexp) []string {
+	switch re.Op {
+	case syntax.OpLiteral:
+		return []string{string(re.Rune)}
+	case syntax.OpCapture, syntax.OpPlus:
+		return requiredLiterals(re.Sub[0])
+	case syntax.OpRepeat:
+		if re.Min >= 1 {
+			return requiredLiterals(re.Sub[0])
+		}
+	case syntax.OpConcat:
+		var literals []string
+		for _, sub := range re.Sub {
+			literals = append(literals, requiredLiterals(sub)...)
+		}
+		return literals
+	}
+	return nil
+}
+
+// candidateFiles returns the files whose terms contain every term of the
+// given literals. When the literals yield no terms, every file is a candidate.
+func candidateFiles(idx *indexer.Index, literals []string) map[string]*indexer.FileEntry {
+	var tokens []indexer.Token
+	for _, literal := range literals {
+		tokens = append(tokens, indexer.Tokenize(literal)...)
+	}
+	if len(tokens) == 0 {
+		return idx.GetFiles()
+	}
+
+	matching := findTokenTerms(idx, tokens)
+	if matching == nil {
+		return make(map[string]*indexer.FileEntry)
+	}
+	files := idx.FilesContaining(matching[0].list)
+	for path, entry := range files {
+		for _, t := range matching[1:] {
+			if len(t.postingsIn(entry.Postings())) == 0 {
+				delete(files, path)
+				break
+			}
+		}
+	}
+	return files
+}
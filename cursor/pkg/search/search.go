@@ -1,83 +1,252 @@
 package search
 
 import (
-	"fmt"
-	"strings"
-	"sync"
+	"context"
+	"log/slog"
+	"regexp"
+	"slices"
+	"sort"
 
 	"indexer/pkg/indexer"
 )
 
 // SearchResult represents a single match in a file
 type SearchResult struct {
-	FilePath   string `json:"file_path"`
-	LineNumber int    `json:"line_number"`
-	Line       string `json:"line"`
-	MatchCount int    `json:"match_count"`
+	FilePath   string  `json:"file_path"`
+	LineNumber int     `json:"line_number"`
+	Line       string  `json:"line"`
+	MatchCount int     `json:"match_count"`
+	Matches    []Match `json:"matches,omitempty"` // Column spans of every match on the line
+	Score      float64 `json:"score,omitempty"`   // Relevance of the file when results are ranked
 }
 
-// Search performs a concurrent search across all indexed files
-func Search(idx *indexer.Index, keyword string) []SearchResult {
-	files := idx.GetFiles()
-	fmt.Printf("Searching through %d indexed files\n", len(files))
-
-	results := make([]SearchResult, 0)
-	resultsChan := make(chan SearchResult)
-	var wg sync.WaitGroup
-
-	// Convert keyword to lowercase for case-insensitive search
-	keyword = strings.ToLower(keyword)
-
-	// Start a worker for each file
-	for path, entry := range files {
-		wg.Add(1)
-		// Create local variables to avoid race condition
-		filePath := path
-		fileEntry := entry
-		go func() {
-			defer wg.Done()
-			searchFile(filePath, fileEntry, keyword, resultsChan)
-		}()
-	}
-
-	// Close results channel when all workers are done
-	go func() {
-		wg.Wait()
-		close(resultsChan)
-	}()
-
-	// Collect results
-	matchCount := 0
-	fileCount := 0
-	filesSeen := make(map[string]bool)
-
-	for result := range resultsChan {
-		if result.MatchCount > 0 {
-			results = append(results, result)
-			matchCount += result.MatchCount
-			if !filesSeen[result.FilePath] {
-				fileCount++
-				filesSeen[result.FilePath] = true
+// Match is the column span of a single match within a line
+type Match struct {
+	Column    int `json:"column"`     // 1-based byte column where the match starts
+	EndColumn int `json:"end_column"` // 1-based byte column just past the match
+}
+
+// fileTask is a file to search, limited to the given lines unless they are nil
+type fileTask struct {
+	path  string
+	entry *indexer.FileEntry
+	lines []int
+}
+
+// Search answers a keyword query from the term index and verifies the
+// candidate lines with jobs workers, or runtime.NumCPU() if jobs is not
+// positive
+func Search(idx *indexer.Index, keyword string, jobs int) []SearchResult {
+	results, _ := SearchContext(context.Background(), idx, keyword, jobs)
+	return results
+}
+
+// SearchContext is like Search but gives up once ctx is done, returning its error
+func SearchContext(ctx context.Context, idx *indexer.Index, keyword string, jobs int) ([]SearchResult, error) {
+	slog.Debug("searching", "files", idx.FileCount())
+
+	if keyword == "" {
+		return make([]SearchResult, 0), nil
+	}
+	pattern := KeywordPattern(keyword)
+
+	var tasks []fileTask
+	candidates, ok := candidateLines(idx, keyword)
+	if ok {
+		// Only files that have candidate lines are searched
+		for path, lines := range candidates {
+			if entry, found := idx.GetFile(path); found {
+				tasks = append(tasks, fileTask{path: path, entry: entry, lines: lines})
 			}
 		}
+	} else {
+		// The keyword has no indexable terms (e.g. only punctuation), so
+		// fall back to scanning every line of every file
+		for path, entry := range idx.GetFiles() {
+			tasks = append(tasks, fileTask{path: path, entry: entry})
+		}
 	}
 
-	fmt.Printf("Found %d matches in %d files\n", matchCount, fileCount)
-	return results
+	results, err := searchFiles(ctx, tasks, jobs, func(task fileTask, batch []SearchResult) []SearchResult {
+		if task.lines != nil {
+			return searchLines(task.path, task.entry, task.lines, pattern, batch)
+		}
+		return searchFile(task.path, task.entry, pattern, batch)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	matchCount, fileCount := summarize(results)
+	slog.Debug("search complete", "matches", matchCount, "files", fileCount)
+	return results, nil
+}
+
+// candidateLines uses the postings of the keyword's terms to find the lines
+// that may contain it, grouped by file. Every term of the keyword must appear
+// within some indexed term on a candidate line. Only the files containing the
+// rarest of them are considered, and only their postings are read. It returns
+// false when the keyword has no terms and cannot be answered from the index.
+func candidateLines(idx *indexer.Index, keyword string) (map[string][]int, bool) {
+	tokens := indexer.Tokenize(keyword)
+	if len(tokens) == 0 {
+		return nil, false
+	}
+
+	byFile := make(map[string][]int)
+	matching := findTokenTerms(idx, tokens)
+	if matching == nil {
+		return byFile, true
+	}
+	for path, entry := range idx.FilesContaining(matching[0].list) {
+		if lines := linesContaining(entry, matching); len(lines) > 0 {
+			byFile[path] = lines
+		}
+	}
+	return byFile, true
+}
+
+// tokenTerms holds the indexed terms containing a token of a keyword
+type tokenTerms struct {
+	list  []string
+	set   map[string]bool // The terms in list, built on first use
+	files int             // Upper bound on the number of files containing any of the terms
+}
+
+// findTokenTerms looks up the indexed terms containing each token, returning
+// them ordered by how many files contain them, fewest first, or nil if a
+// token is in no term, so that nothing can match
+func findTokenTerms(idx *indexer.Index, tokens []indexer.Token) []*tokenTerms {
+	// Longer tokens are cheaper to look up and more likely to be in no term
+	tokens = slices.Clone(tokens)
+	sort.SliceStable(tokens, func(i, j int) bool {
+		return len(tokens[i].Term) > len(tokens[j].Term)
+	})
+
+	matching := make([]*tokenTerms, len(tokens))
+	for i, tok := range tokens {
+		list := idx.TermsContaining(tok.Term)
+		if len(list) == 0 {
+			return nil
+		}
+		matching[i] = &tokenTerms{list: list}
+	}
+	for _, t := range matching {
+		for _, term := range t.list {
+			t.files += idx.DocFreq(term)
+		}
+	}
+	sort.SliceStable(matching, func(i, j int) bool {
+		return matching[i].files < matching[j].files
+	})
+	return matching
 }
 
-// searchFile searches for the keyword in a single file
-func searchFile(path string, entry *indexer.FileEntry, keyword string, results chan<- SearchResult) {
-	for lineNum, line := range entry.LineIndex {
-		lowerLine := strings.ToLower(line)
-		count := strings.Count(lowerLine, keyword)
-		if count > 0 {
-			results <- SearchResult{
-				FilePath:   path,
-				LineNumber: lineNum,
-				Line:       line,
-				MatchCount: count,
+// postingsIn returns the postings lists that a file's postings hold for the
+// terms, going through whichever of the two is smaller
+func (t *tokenTerms) postingsIn(postings map[string][]indexer.Posting) [][]indexer.Posting {
+	var lists [][]indexer.Posting
+	if len(t.list) < len(postings) {
+		for _, term := range t.list {
+			if list, ok := postings[term]; ok {
+				lists = append(lists, list)
 			}
 		}
+		return lists
+	}
+	if t.set == nil {
+		t.set = make(map[string]bool, len(t.list))
+		for _, term := range t.list {
+			t.set[term] = true
+		}
+	}
+	for term, list := range postings {
+		if t.set[term] {
+			lists = append(lists, list)
+		}
+	}
+	return lists
+}
+
+// linesContaining returns the lines of a file, in order, that have one of
+// the terms of every token
+func linesContaining(entry *indexer.FileEntry, matching []*tokenTerms) []int {
+	var lines map[int]bool
+	for _, t := range matching {
+		found := make(map[int]bool)
+		for _, list := range t.postingsIn(entry.Postings()) {
+			for _, p := range list {
+				if lines == nil || lines[p.Line] {
+					found[p.Line] = true
+				}
+			}
+		}
+		if len(found) == 0 {
+			return nil
+		}
+		lines = found
+	}
+
+	sorted := make([]int, 0, len(lines))
+	for line := range lines {
+		sorted = append(sorted, line)
+	}
+	sort.Ints(sorted)
+	return sorted
+}
+
+// searchLines verifies the keyword pattern against the given lines of a
+// single file, appending matches to results
+func searchLines(path string, entry *indexer.FileEntry, lines []int, pattern *regexp.Regexp, results []SearchResult) []SearchResult {
+	for _, lineNum := range lines {
+		if lineNum < 1 || lineNum > entry.LineCount() {
+			continue
+		}
+		results = matchLine(path, lineNum, entry.Line(lineNum), pattern, results)
+	}
+	return results
+}
+
+// searchFile searches for the keyword pattern in every line of a single
+// file, appending matches to results
+func searchFile(path string, entry *indexer.FileEntry, pattern *regexp.Regexp, results []SearchResult) []SearchResult {
+	for lineNum, line := range entry.Lines() {
+		results = matchLine(path, lineNum, line, pattern, results)
+	}
+	return results
+}
+
+// matchLine appends the line to results if the pattern matches it
+func matchLine(path string, lineNum int, line string, pattern *regexp.Regexp, results []SearchResult) []SearchResult {
+	matches := FindMatches(line, pattern)
+	if len(matches) == 0 {
+		return results
+	}
+	return append(results, SearchResult{
+		FilePath:   path,
+		LineNumber: lineNum,
+		Line:       line,
+		MatchCount: len(matches),
+		Matches:    matches,
+	})
+}
+
+// KeywordPattern compiles a pattern matching keyword literally and case
+// insensitively. Matching the line itself, rather than a lowercased copy
+// whose length can differ, keeps the spans valid offsets into it.
+func KeywordPattern(keyword string) *regexp.Regexp {
+	return regexp.MustCompile("(?i)" + regexp.QuoteMeta(keyword))
+}
+
+// FindMatches returns the spans of every match of the pattern in line
+func FindMatches(line string, pattern *regexp.Regexp) []Match {
+	spans := pattern.FindAllStringIndex(line, -1)
+	if len(spans) == 0 {
+		return nil
+	}
+	matches := make([]Match, len(spans))
+	for i, span := range spans {
+		matches[i] = Match{Column: span[0] + 1, EndColumn: span[1] + 1}
 	}
+	return matches
 }
@@ -0,0 +1,35 @@
+package search
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestFindMatches(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		keyword string
+		want    []Match
+	}{
+		{"exact", "foo bar", "bar", []Match{{5, 8}}},
+		{"case insensitive", "Foo FOO foo", "foo", []Match{{1, 4}, {5, 8}, {9, 12}}},
+		{"uppercase keyword", "foo", "FOO", []Match{{1, 4}}},
+		{"no overlaps", "aaaa", "aa", []Match{{1, 3}, {3, 5}}},
+		{"metacharacters are literal", "a.b axb", "a.b", []Match{{1, 4}}},
+		{"no match", "foo", "bar", nil},
+		// Lowercasing these changes their length, which must not shift the spans
+		{"after longer lowercase", "İ foo", "foo", []Match{{4, 7}}},
+		{"after shorter lowercase", "ẞ foo", "foo", []Match{{5, 8}}},
+		{"capital sharp s", "STRAẞE", "straße", []Match{{1, 9}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := FindMatches(tt.line, KeywordPattern(tt.keyword))
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("FindMatches(%q, %q) = %v, want %v", tt.line, tt.keyword, got, tt.want)
+			}
+		})
+	}
+}
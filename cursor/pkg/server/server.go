@@ -0,0 +1,333 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"indexer/pkg/cache"
+	"indexer/pkg/indexer"
+	"indexer/pkg/query"
+	"indexer/pkg/search"
+)
+
+// SearchResponse is the body of a /search response. Blocks are only set
+// when context lines were requested.
+type SearchResponse struct {
+	Query   string                `json:"query"`
+	Count   int                   `json:"count"`
+	Results []search.SearchResult `json:"results"`
+	Blocks  []search.Block        `json:"blocks,omitempty"`
+}
+
+// FileInfo summarises an indexed file in a /files response
+type FileInfo struct {
+	Path     string `json:"path"`
+	Lines    int    `json:"lines"`
+	Size     int64  `json:"size"`
+	Modified int64  `json:"modified"`
+}
+
+// StatsResponse is the body of a /stats response
+type StatsResponse struct {
+	Files            int                 `json:"files"`
+	Roots            []indexer.Root      `json:"roots"`
+	AverageDocLength float64             `json:"average_doc_length"`
+	LastChanges      indexer.ChangeStats `json:"last_changes"` // Changes made by the most recent indexing run
+}
+
+// ReindexResponse is the body of a /reindex response
+type ReindexResponse struct {
+	Roots   []string            `json:"roots"` // The directories that were indexed
+	Files   int                 `json:"files"`
+	Changes indexer.ChangeStats `json:"changes"` // Changes summed over all indexed directories
+}
+
+// errorResponse is the body of every failed request
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// Server answers requests from an index held in memory, so the cache only
+// has to be loaded once
+type Server struct {
+	idx   *indexer.Index
+	cache *cache.Cache
+	mux   *http.ServeMux
+	mu    sync.Mutex // Serialises indexing runs, which share the index counters
+
+	// AllowNewRoots lets /reindex index a directory that is not a root yet.
+	// Otherwise its path must be one of the indexed roots.
+	AllowNewRoots bool
+
+	// Addr is the address the server listens on. When set, requests must be
+	// sent to it, to localhost or to an IP address, so that a web page cannot
+	// reach the server through a DNS name that it rebinds to a local address.
+	Addr string
+}
+
+// maxContext is the most lines of context a search may ask for
+const maxContext = 50
+
+// New creates a server for an index and the cache it is saved to
+func New(idx *indexer.Index, cache *cache.Cache) *Server {
+	s := &Server{
+		idx:   idx,
+		cache: cache,
+		mux:   http.NewServeMux(),
+	}
+	s.mux.HandleFunc("GET /{$}", s.handleIndexPage)
+	s.mux.HandleFunc("GET /view", s.handleView)
+	s.mux.HandleFunc("GET /search", s.handleSearch)
+	s.mux.HandleFunc("GET /files", s.handleFiles)
+	s.mux.HandleFunc("GET /stats", s.handleStats)
+	s.mux.HandleFunc("POST /reindex", s.handleReindex)
+	return s
+}
+
+// ServeHTTP dispatches a request to its endpoint. Requests for another host
+// are refused, as are requests that change the index when they come from
+// another origin, so that web pages cannot make a browser send them.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.allowedHost(r.Host) {
+		writeError(w, http.StatusForbidden, fmt.Errorf("requests for host %q are not allowed", r.Host))
+		return
+	}
+	if !safeMethod(r.Method) && crossOrigin(r) {
+		writeError(w, http.StatusForbidden, fmt.Errorf("cross-origin requests are not allowed"))
+		return
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+// allowedHost reports whether a request's Host names the server: its listen
+// address, localhost or an IP address, none of which a DNS rebinding attack
+// can send
+func (s *Server) allowedHost(host string) bool {
+	if s.Addr == "" {
+		return true
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.Trim(host, "[]"), ".")
+	if strings.EqualFold(host, "localhost") || net.ParseIP(host) != nil {
+		return true
+	}
+	listen, _, err := net.SplitHostPort(s.Addr)
+	return err == nil && listen != "" && strings.EqualFold(host, listen)
+}
+
+// safeMethod reports whether a request method only reads
+func safeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// crossOrigin reports whether a browser sent the request from a page on
+// another origin. Browsers set Sec-Fetch-Site; older ones only set Origin,
+// which is compared with the host the request was sent to. Requests from
+// other clients have neither.
+func crossOrigin(r *http.Request) bool {
+	switch r.Header.Get("Sec-Fetch-Site") {
+	case "":
+	case "same-origin", "none":
+		return false
+	default:
+		return true
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return false
+	}
+	u, err := url.Parse(origin)
+	return err != nil || u.Host != r.Host
+}
+
+// handleSearch runs a search. Parameters:
+//
+//	q      the keyword, pattern or query (required)
+//	mode   keyword (default), regex or query
+//	scope  file (default) or line, for query mode
+//	rank   order files by BM25 relevance when true
+//	jobs   search workers (default: one per CPU)
+//	A B C  lines of context after, before or around each match
+func (s *Server) handleSearch(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	text := params.Get("q")
+	if text == "" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("missing q parameter"))
+		return
+	}
+
+	var opts query.Options
+	var err error
+	if opts.Mode, err = query.ParseMode(params.Get("mode")); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if scope := params.Get("scope"); scope != "" {
+		if opts.Scope, err = query.ParseScope(scope); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	if opts.Rank, err = boolParam(params.Get("rank")); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if opts.Jobs, err = intParam(params.Get("jobs")); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid jobs parameter: %w", err))
+		return
+	}
+	lines := make(map[string]int)
+	for _, name := range []string{"A", "B", "C"} {
+		if lines[name], err = contextParam(params.Get(name)); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid %s parameter: %w", name, err))
+			return
+		}
+	}
+
+	results, err := query.RunContext(r.Context(), s.idx, text, opts)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	response := SearchResponse{Query: text, Count: len(results), Results: results}
+	before, after := max(lines["B"], lines["C"]), max(lines["A"], lines["C"])
+	if before > 0 || after > 0 {
+		response.Blocks = search.WithContext(s.idx, results, before, after)
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// handleFiles lists the indexed files sorted by path
+func (s *Server) handleFiles(w http.ResponseWriter, r *http.Request) {
+	entries := s.idx.GetFiles()
+	files := make([]FileInfo, 0, len(entries))
+	for path, entry := range entries {
+		files = append(files, FileInfo{
+			Path:     path,
+			Lines:    entry.LineCount(),
+			Size:     entry.Size,
+			Modified: entry.Modified,
+		})
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Path < files[j].Path
+	})
+	writeJSON(w, http.StatusOK, files)
+}
+
+// handleStats reports the size of the index and its roots
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, StatsResponse{
+		Files:            s.idx.FileCount(),
+		Roots:            s.idx.Roots(),
+		AverageDocLength: s.idx.AverageDocLength(),
+		LastChanges:      s.idx.Changes(),
+	})
+}
+
+// handleReindex indexes every root again, or only the directory given by the
+// path parameter, and saves the cache. The directory must be a root unless
+// new roots are allowed, in which case it is added if it is new.
+func (s *Server) handleReindex(w http.ResponseWriter, r *http.Request) {
+	var dirs []string
+	if path := r.URL.Query().Get("path"); path != "" {
+		if !filepath.IsAbs(path) {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("path must be absolute"))
+			return
+		}
+		path = filepath.Clean(path)
+		if !s.AllowNewRoots && !s.isRoot(path) {
+			writeError(w, http.StatusForbidden, fmt.Errorf("%s is not an indexed root", path))
+			return
+		}
+		dirs = []string{path}
+	} else {
+		for _, root := range s.idx.Roots() {
+			dirs = append(dirs, root.Path)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	response := ReindexResponse{Roots: dirs}
+	for _, dir := range dirs {
+		if err := s.idx.IndexDirectoryContext(r.Context(), dir); err != nil {
+			writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to index %s: %w", dir, err))
+			return
+		}
+		changes := s.idx.Changes()
+		response.Changes.Added += changes.Added
+		response.Changes.Updated += changes.Updated
+		response.Changes.Removed += changes.Removed
+		response.Changes.Unchanged += changes.Unchanged
+	}
+	if err := s.cache.Save(s.idx); err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to save cache: %w", err))
+		return
+	}
+	response.Files = s.idx.FileCount()
+	writeJSON(w, http.StatusOK, response)
+}
+
+// isRoot reports whether path is one of the indexed roots
+func (s *Server) isRoot(path string) bool {
+	for _, root := range s.idx.Roots() {
+		if root.Path == path {
+			return true
+		}
+	}
+	return false
+}
+
+// boolParam parses an optional boolean query parameter
+func boolParam(value string) (bool, error) {
+	if value == "" {
+		return false, nil
+	}
+	return strconv.ParseBool(value)
+}
+
+// intParam parses an optional non-negative integer query parameter
+func intParam(value string) (int, error) {
+	if value == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err == nil && n < 0 {
+		err = fmt.Errorf("must not be negative")
+	}
+	return n, err
+}
+
+// contextParam parses an optional number of context lines, up to maxContext
+func contextParam(value string) (int, error) {
+	n, err := intParam(value)
+	if err == nil && n > maxContext {
+		err = fmt.Errorf("must be at most %d", maxContext)
+	}
+	return n, err
+}
+
+// writeJSON writes v as the JSON body of a response
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError writes an error as a JSON response
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, errorResponse{Error: err.Error()})
+}
@@ -0,0 +1,219 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"sort"
+
+	"indexer/pkg/query"
+	"indexer/pkg/search"
+)
+
+//go:embed templates/*.html
+var templateFS embed.FS
+
+// templates holds the pages of the web UI
+var templates = template.Must(template.New("").Funcs(template.FuncMap{
+	"viewURL":  viewURL,
+	"lineData": lineData,
+}).ParseFS(templateFS, "templates/*.html"))
+
+// Web UI limits
+const (
+	defaultContext = 2   // Lines of context shown around matches
+	maxBlocks      = 500 // Blocks rendered on a results page
+)
+
+// segment is a piece of a line, highlighted when it is part of a match
+type segment struct {
+	Text  string
+	Match bool
+}
+
+// pageLine is a line rendered with its number
+type pageLine struct {
+	Number   int
+	Match    bool
+	Segments []segment
+}
+
+// pageBlock is a group of consecutive lines from one file
+type pageBlock struct {
+	Path  string
+	Score float64
+	Lines []pageLine
+}
+
+// searchPage is the data of the search page
+type searchPage struct {
+	Query   string
+	Mode    string
+	Scope   string
+	Rank    bool
+	Context int
+	Error   string
+	Count   int
+	Files   int
+	Blocks  []pageBlock
+	Omitted int // Blocks beyond maxBlocks that were not rendered
+}
+
+// viewPage is the data of the file viewer
+type viewPage struct {
+	Path  string
+	Lines []pageLine
+}
+
+// handleIndexPage renders the search form and, when a query is given, its
+// results with highlighted matches and context
+func (s *Server) handleIndexPage(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	page := searchPage{
+		Query:   params.Get("q"),
+		Mode:    params.Get("mode"),
+		Scope:   params.Get("scope"),
+		Rank:    params.Get("rank") != "",
+		Context: defaultContext,
+	}
+	if c := params.Get("C"); c != "" {
+		n, err := contextParam(c)
+		if err != nil {
+			page.Error = fmt.Sprintf("invalid context: %v", err)
+		}
+		page.Context = n
+	}
+
+	if page.Query != "" && page.Error == "" {
+		if err := s.runSearchPage(r.Context(), &page); err != nil {
+			page.Error = err.Error()
+		}
+	}
+	render(w, "search.html", page)
+}
+
+// runSearchPage runs the search described by a page and fills in its results
+func (s *Server) runSearchPage(ctx context.Context, page *searchPage) error {
+	opts := query.Options{Rank: page.Rank}
+	var err error
+	if opts.Mode, err = query.ParseMode(page.Mode); err != nil {
+		return err
+	}
+	if page.Scope != "" {
+		if opts.Scope, err = query.ParseScope(page.Scope); err != nil {
+			return err
+		}
+	}
+
+	results, err := query.RunContext(ctx, s.idx, page.Query, opts)
+	if err != nil {
+		return err
+	}
+	page.Count = len(results)
+
+	blocks := search.WithContext(s.idx, results, page.Context, page.Context)
+	files := make(map[string]bool)
+	for i, block := range blocks {
+		files[block.FilePath] = true
+		if i >= maxBlocks {
+			page.Omitted++
+			continue
+		}
+		pb := pageBlock{Path: block.FilePath, Score: block.Score}
+		for _, line := range block.Lines {
+			pb.Lines = append(pb.Lines, pageLine{
+				Number:   line.LineNumber,
+				Match:    line.Match,
+				Segments: highlight(line.Line, line.Matches),
+			})
+		}
+		page.Blocks = append(page.Blocks, pb)
+	}
+	page.Files = len(files)
+	return nil
+}
+
+// handleView renders an indexed file with numbered, linkable lines
+func (s *Server) handleView(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Query().Get("path")
+	entry, ok := s.idx.GetFile(path)
+	if !ok {
+		http.Error(w, "file not found in index", http.StatusNotFound)
+		return
+	}
+
+	page := viewPage{Path: path}
+	for lineNum, line := range entry.Lines() {
+		page.Lines = append(page.Lines, pageLine{
+			Number:   lineNum,
+			Segments: []segment{{Text: line}},
+		})
+	}
+	render(w, "view.html", page)
+}
+
+// highlight splits a line into plain and matching segments. Overlapping
+// and out of range spans are tolerated.
+func highlight(line string, matches []search.Match) []segment {
+	spans := append([]search.Match(nil), matches...)
+	sort.Slice(spans, func(i, j int) bool {
+		return spans[i].Column < spans[j].Column
+	})
+
+	var segments []segment
+	pos := 0 // Byte offset of the first unwritten character
+	for _, m := range spans {
+		start, end := max(m.Column-1, pos), min(m.EndColumn-1, len(line))
+		if start >= end {
+			continue
+		}
+		if start > pos {
+			segments = append(segments, segment{Text: line[pos:start]})
+		}
+		segments = append(segments, segment{Text: line[start:end], Match: true})
+		pos = end
+	}
+	if pos < len(line) || len(segments) == 0 {
+		segments = append(segments, segment{Text: line[pos:]})
+	}
+	return segments
+}
+
+// viewURL links to a file in the viewer, scrolled to a line when it is positive
+func viewURL(path string, line int) string {
+	u := "/view?path=" + url.QueryEscape(path)
+	if line > 0 {
+		u += fmt.Sprintf("#L%d", line)
+	}
+	return u
+}
+
+// lineLink is the data of the "line" template: a line and where its number links to
+type lineLink struct {
+	URL  string
+	Line pageLine
+}
+
+// lineData links a line to its place in the viewer, or to its own anchor
+// when path is empty because the line is already shown in the viewer
+func lineData(path string, line pageLine) lineLink {
+	if path == "" {
+		return lineLink{URL: fmt.Sprintf("#L%d", line.Number), Line: line}
+	}
+	return lineLink{URL: viewURL(path, line.Number), Line: line}
+}
+
+// render executes a page template, writing nothing but an error if it fails
+func render(w http.ResponseWriter, name string, data any) {
+	var buf bytes.Buffer
+	if err := templates.ExecuteTemplate(&buf, name, data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	buf.WriteTo(w)
+}
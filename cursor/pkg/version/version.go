@@ -0,0 +1,5 @@
+package version
+
+// Version is the version of indexer. Caches record the version that wrote
+// them so that a cache from a newer version can be reported as such.
+const Version = "1.0.0"
@@ -0,0 +1,179 @@
+//go:build linux
+
+package watch
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"indexer/pkg/ignore"
+	"indexer/pkg/indexer"
+)
+
+// Events that change what a file contains or where it is
+const watchMask = syscall.IN_CLOSE_WRITE | syscall.IN_CREATE | syscall.IN_DELETE |
+	syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_DELETE_SELF
+
+// inotify watches a directory tree with the Linux inotify API. Every
+// directory needs its own watch, so directories created later are added as
+// their creation is reported.
+type inotify struct {
+	file    *os.File
+	root    string
+	matcher *ignore.Matcher  // Only used by the reading goroutine after setup
+	dirs    map[int32]string // Maps watch descriptors to directories
+	events  chan string
+	done    chan struct{}
+	once    sync.Once
+}
+
+// newNotifier starts watching every directory beneath root that the indexer
+// would walk
+func newNotifier(root string) (notifier, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+
+	// A non-blocking descriptor lets the runtime poller wake up reads on Close
+	n := &inotify{
+		file:    os.NewFile(uintptr(fd), "inotify"),
+		root:    root,
+		matcher: ignore.New(root),
+		dirs:    make(map[int32]string),
+		events:  make(chan string),
+		done:    make(chan struct{}),
+	}
+	if err := n.addTree(root); err != nil {
+		n.file.Close()
+		return nil, err
+	}
+
+	go n.read()
+	return n, nil
+}
+
+// Events returns the channel of changed paths
+func (n *inotify) Events() <-chan string {
+	return n.events
+}
+
+// Close stops watching
+func (n *inotify) Close() error {
+	var err error
+	n.once.Do(func() {
+		close(n.done)
+		err = n.file.Close()
+	})
+	return err
+}
+
+// addTree adds watches for dir and every directory beneath it, skipping the
+// directories the indexer skips
+func (n *inotify) addTree(dir string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return nil
+		}
+		if path != n.root && (indexer.SkippedDir(info.Name()) || n.matcher.Ignored(path, true)) {
+			return filepath.SkipDir
+		}
+		n.matcher.AddDir(path)
+
+		wd, err := syscall.InotifyAddWatch(int(n.file.Fd()), path, watchMask)
+		if err != nil {
+			// The root must be watchable; vanished subdirectories are not an error
+			if path == dir {
+				return os.NewSyscallError("inotify_add_watch", err)
+			}
+			return nil
+		}
+		n.dirs[int32(wd)] = path
+		return nil
+	})
+}
+
+// removeTree removes the watches of dir and every directory beneath it
+func (n *inotify) removeTree(dir string) {
+	prefix := dir + string(filepath.Separator)
+	for wd, path := range n.dirs {
+		if path == dir || strings.HasPrefix(path, prefix) {
+			syscall.InotifyRmWatch(int(n.file.Fd()), uint32(wd))
+			delete(n.dirs, wd)
+		}
+	}
+}
+
+// read decodes events until the notifier is closed
+func (n *inotify) read() {
+	defer close(n.events)
+
+	buf := make([]byte, 64*1024)
+	for {
+		count, err := n.file.Read(buf)
+		if err != nil {
+			return
+		}
+
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= count; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameStart := offset + syscall.SizeofInotifyEvent
+			name := string(bytes.TrimRight(buf[nameStart:nameStart+int(event.Len)], "\x00"))
+			offset = nameStart + int(event.Len)
+
+			if !n.handle(event, name) {
+				return
+			}
+		}
+	}
+}
+
+// handle processes a single event, returning false once the notifier is closed
+func (n *inotify) handle(event *syscall.InotifyEvent, name string) bool {
+	if event.Mask&syscall.IN_Q_OVERFLOW != 0 {
+		return n.send("")
+	}
+	if event.Mask&syscall.IN_IGNORED != 0 {
+		delete(n.dirs, event.Wd)
+		return true
+	}
+
+	dir, ok := n.dirs[event.Wd]
+	if !ok {
+		return true
+	}
+	path := dir
+	if name != "" {
+		path = filepath.Join(dir, name)
+	}
+
+	// Watch new directories, including any created before the watch was added
+	if event.Mask&syscall.IN_ISDIR != 0 && event.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+		n.addTree(path)
+	}
+	// A directory moved away keeps its watches, which would report its
+	// files under the old path, so drop them as if it had been deleted
+	if event.Mask&syscall.IN_ISDIR != 0 && event.Mask&syscall.IN_MOVED_FROM != 0 {
+		n.removeTree(path)
+	}
+	if event.Mask&syscall.IN_DELETE_SELF != 0 && name == "" {
+		// The deletion was already reported by the parent directory's watch
+		return true
+	}
+	return n.send(path)
+}
+
+// send delivers a path unless the notifier is closed
+func (n *inotify) send(path string) bool {
+	select {
+	case n.events <- path:
+		return true
+	case <-n.done:
+		return false
+	}
+}
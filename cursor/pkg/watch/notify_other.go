@@ -0,0 +1,11 @@
+//go:build !linux
+
+package watch
+
+import "errors"
+
+// newNotifier reports that file events are not supported, so that the
+// watcher falls back to polling
+func newNotifier(root string) (notifier, error) {
+	return nil, errors.New("not supported on this platform")
+}
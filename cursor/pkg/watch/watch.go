@@ -0,0 +1,182 @@
+package watch
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"indexer/pkg/cache"
+	"indexer/pkg/indexer"
+)
+
+// Default timings of a Watcher
+const (
+	DefaultInterval = 2 * time.Second
+	DefaultDebounce = time.Second
+)
+
+// notifier delivers the paths of changed files. An empty path means events
+// were lost and the whole tree should be rescanned.
+type notifier interface {
+	Events() <-chan string
+	Close() error
+}
+
+// Watcher keeps the index of a directory up to date as its files change and
+// saves the directory to the cache once changes have settled, merging it
+// with what other processes have saved meanwhile. File events are
+// used where the platform supports them; otherwise the directory is rescanned
+// periodically, which only re-reads files whose modification time or size
+// changed.
+type Watcher struct {
+	idx   *indexer.Index
+	cache *cache.Cache
+	root  string
+	out   io.Writer
+
+	Interval time.Duration // How often to rescan when file events are unavailable
+	Debounce time.Duration // How long changes must settle before the cache is saved
+}
+
+// New creates a watcher for root
+func New(idx *indexer.Index, cache *cache.Cache, root string) *Watcher {
+	return &Watcher{
+		idx:      idx,
+		cache:    cache,
+		root:     filepath.Clean(root),
+		out:      os.Stdout,
+		Interval: DefaultInterval,
+		Debounce: DefaultDebounce,
+	}
+}
+
+// Run indexes the root, saves the index and then keeps it up to date until
+// ctx is done. Pending changes are saved before Run returns. If ctx is done
+// while the root is first indexed, Run returns its error without saving.
+func (w *Watcher) Run(ctx context.Context) error {
+	if err := w.idx.IndexDirectoryContext(ctx, w.root); err != nil {
+		return err
+	}
+	if err := w.save(); err != nil {
+		return err
+	}
+
+	// The rescan ticker only runs once file events are unavailable
+	var events <-chan string
+	var ticks <-chan time.Time
+	ticker := time.NewTicker(w.Interval)
+	ticker.Stop()
+	defer ticker.Stop()
+	poll := func(reason error) {
+		slog.Warn("file events unavailable, rescanning periodically", "reason", reason, "interval", w.Interval)
+		ticker.Reset(w.Interval)
+		ticks = ticker.C
+	}
+	if n, err := newNotifier(w.root); err != nil {
+		poll(err)
+	} else {
+		defer n.Close()
+		events = n.Events()
+	}
+	slog.Info("watching for changes (press Ctrl+C to stop)", "root", w.root)
+
+	// The save timer only runs while there are unsaved changes
+	save := time.NewTimer(w.Debounce)
+	save.Stop()
+	dirty := false
+	changed := func() {
+		dirty = true
+		save.Reset(w.Debounce)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			save.Stop()
+			if dirty {
+				return w.save()
+			}
+			return nil
+
+		case path, ok := <-events:
+			if !ok {
+				events = nil
+				poll(fmt.Errorf("notifier stopped"))
+				continue
+			}
+			if w.update(path) {
+				changed()
+			}
+
+		case <-ticks:
+			if w.rescan() {
+				changed()
+			}
+
+		case <-save.C:
+			if err := w.save(); err != nil {
+				slog.Warn("cannot save index", "error", err)
+				continue
+			}
+			dirty = false
+		}
+	}
+}
+
+// update applies a file event to the index and reports whether it changed.
+// An empty path or a directory triggers a rescan of the whole root.
+func (w *Watcher) update(path string) bool {
+	if path == "" {
+		return w.rescan()
+	}
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		return w.rescan()
+	}
+
+	change, err := w.idx.Refresh(path)
+	if err != nil {
+		slog.Warn("failed to update file", "path", path, "error", err)
+		return false
+	}
+	if change == indexer.Unchanged {
+		return false
+	}
+	fmt.Fprintf(w.out, "%s %s: %s\n", time.Now().Format("15:04:05"), change, w.rel(path))
+	return true
+}
+
+// rescan indexes the root again and reports whether anything changed
+func (w *Watcher) rescan() bool {
+	if err := w.idx.IndexDirectory(w.root); err != nil {
+		slog.Warn("failed to rescan", "root", w.root, "error", err)
+		return false
+	}
+	changes := w.idx.Changes()
+	if changes.Added+changes.Updated+changes.Removed == 0 {
+		return false
+	}
+	fmt.Fprintf(w.out, "%s rescanned: %d added, %d updated, %d removed\n",
+		time.Now().Format("15:04:05"), changes.Added, changes.Updated, changes.Removed)
+	return true
+}
+
+// save writes the watched root to the cache
+func (w *Watcher) save() error {
+	if err := w.cache.SaveRoot(w.idx, w.root); err != nil {
+		return fmt.Errorf("failed to save cache: %w", err)
+	}
+	slog.Info("saved index", "files", w.idx.FileCount())
+	return nil
+}
+
+// rel returns path relative to the watched root for display
+func (w *Watcher) rel(path string) string {
+	if rel, err := filepath.Rel(w.root, path); err == nil {
+		return rel
+	}
+	return path
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	"indexer/pkg/indexer"
+)
+
+// Intervals between progress reports on a terminal, where the line is
+// redrawn in place, and elsewhere, where every report is a log record
+const (
+	progressInterval    = 200 * time.Millisecond
+	progressLogInterval = 10 * time.Second
+)
+
+// clearLine returns the cursor to the start of the line and erases it
+const clearLine = "\r\033[K"
+
+// progressPrinter shows the progress of indexing on a file: as a single
+// line kept up to date when the file is a terminal, and as a log record
+// every progressLogInterval otherwise. Log records and other output written
+// through it are printed above the progress line.
+type progressPrinter struct {
+	mu   sync.Mutex
+	out  *os.File
+	tty  bool
+	line string // Progress line shown on the terminal, if any
+}
+
+// newProgressPrinter creates a printer writing to out
+func newProgressPrinter(out *os.File) *progressPrinter {
+	info, err := out.Stat()
+	return &progressPrinter{
+		out: out,
+		tty: err == nil && info.Mode()&os.ModeCharDevice != 0,
+	}
+}
+
+// interval returns how often progress should be reported
+func (p *progressPrinter) interval() time.Duration {
+	if p.tty {
+		return progressInterval
+	}
+	return progressLogInterval
+}
+
+// Write prints output above the progress line
+func (p *progressPrinter) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.line == "" {
+		return p.out.Write(b)
+	}
+	fmt.Fprint(p.out, clearLine)
+	n, err := p.out.Write(b)
+	fmt.Fprint(p.out, p.line)
+	return n, err
+}
+
+// update shows a progress report. The line on a terminal is removed once
+// indexing is done, since a summary follows.
+func (p *progressPrinter) update(progress indexer.Progress) {
+	if !p.tty {
+		// Logging writes through p, so it must not hold the lock
+		if !progress.Done {
+			logProgress(progress)
+		}
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	switch {
+	case progress.Done:
+		if p.line != "" {
+			fmt.Fprint(p.out, clearLine)
+			p.line = ""
+		}
+	default:
+		p.line = formatProgress(progress)
+		fmt.Fprint(p.out, clearLine+p.line)
+	}
+}
+
+// logProgress logs a progress report
+func logProgress(p indexer.Progress) {
+	attrs := []any{
+		"processed", p.Processed,
+		"discovered", p.Discovered,
+		"walked", p.Walked,
+		"bytes", p.Bytes,
+		"files_per_second", math.Round(p.FilesPerSecond()),
+		"bytes_per_second", math.Round(p.BytesPerSecond()),
+	}
+	if eta, ok := p.ETA(); ok {
+		attrs = append(attrs, "eta", eta.Round(time.Second))
+	}
+	slog.Info("indexing progress", attrs...)
+}
+
+// formatProgress describes a progress report in one line. The total is
+// marked with a "+" while the walk is still finding files.
+func formatProgress(p indexer.Progress) string {
+	files := fmt.Sprintf("%d/%d+ files", p.Processed, p.Discovered)
+	if p.Walked {
+		files = fmt.Sprintf("%d/%d files", p.Processed, p.Discovered)
+		if p.Discovered > 0 {
+			files += fmt.Sprintf(" (%d%%)", p.Processed*100/p.Discovered)
+		}
+	}
+	line := fmt.Sprintf("Indexing: %s, %.1f MB, %.0f files/s, %.1f MB/s",
+		files, float64(p.Bytes)/(1024*1024), p.FilesPerSecond(), p.BytesPerSecond()/(1024*1024))
+	if eta, ok := p.ETA(); ok {
+		line += ", ETA " + eta.Round(time.Second).String()
+	}
+	return line
+}
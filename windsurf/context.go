@@ -0,0 +1,71 @@
+package main
+
+import "sort"
+
+// ContextLine is a line shown around search results
+type ContextLine struct {
+	LineNumber int    `json:"lineNumber"`
+	Text       string `json:"text"`
+	Match      bool   `json:"match"` // False for context lines
+}
+
+// ContextBlock is a run of consecutive lines of one file around one or more results
+type ContextBlock struct {
+	FilePath string        `json:"filePath"`
+	Lines    []ContextLine `json:"lines"`
+}
+
+// Context groups results into blocks holding up to before lines preceding
+// and after lines following each result line. Windows that overlap or touch
+// are merged, and files keep the order in which they first appear in results.
+func (idx *Indexer) Context(results []SearchResult, before, after int) []ContextBlock {
+	var order []string
+	matchLines := make(map[string]map[int]bool)
+	for _, result := range results {
+		if _, ok := matchLines[result.FilePath]; !ok {
+			order = append(order, result.FilePath)
+			matchLines[result.FilePath] = make(map[int]bool)
+		}
+		matchLines[result.FilePath][result.LineNumber] = true
+	}
+
+	idx.mutex.RLock()
+	defer idx.mutex.RUnlock()
+
+	var blocks []ContextBlock
+	for _, path := range order {
+		fileIndex, ok := idx.index.Files[path]
+		if !ok {
+			continue
+		}
+
+		lineNums := make([]int, 0, len(matchLines[path]))
+		for lineNum := range matchLines[path] {
+			lineNums = append(lineNums, lineNum)
+		}
+		sort.Ints(lineNums)
+
+		last := 0 // Last line number added to a block of this file
+		for _, lineNum := range lineNums {
+			start := max(lineNum-before, 1)
+			end := min(lineNum+after, fileIndex.LineCount())
+
+			// Start a new block unless this window overlaps or touches the previous one
+			if last == 0 || start > last+1 {
+				blocks = append(blocks, ContextBlock{FilePath: path})
+				last = start - 1
+			}
+
+			block := &blocks[len(blocks)-1]
+			for n := last + 1; n <= end; n++ {
+				block.Lines = append(block.Lines, ContextLine{
+					LineNumber: n,
+					Text:       fileIndex.Line(n),
+					Match:      matchLines[path][n],
+				})
+			}
+			last = max(last, end)
+		}
+	}
+	return blocks
+}
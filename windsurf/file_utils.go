@@ -1,9 +1,14 @@
 package main
 
 import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
+	"unicode/utf8"
 )
 
 // DefaultExcludedDirs is a list of directories that are excluded from indexing by default
@@ -20,56 +25,177 @@ var DefaultExcludedExtensions = []string{
 	".class", ".pyc", ".pyo", ".obj",
 }
 
+// TextExtensions is a list of file extensions that are always treated as text
+var TextExtensions = []string{
+	".txt", ".md", ".json", ".xml", ".html", ".htm", ".css", ".js",
+	".go", ".py", ".java", ".c", ".cpp", ".h", ".hpp", ".cs", ".php",
+	".rb", ".pl", ".sh", ".bat", ".ps1", ".yaml", ".yml", ".toml",
+	".ini", ".cfg", ".conf", ".log", ".csv", ".tsv",
+}
+
+// sniffSize is how much of a file is read to decide whether it is a text file
+const sniffSize = 8 * 1024
+
 // ShouldIndexFile determines if a file should be indexed based on path and extension
 func ShouldIndexFile(path string) bool {
+	ok, _ := indexReason(path)
+	return ok
+}
+
+// indexReason is like ShouldIndexFile but also describes why a file is skipped
+func indexReason(path string) (bool, string) {
 	// Check if the file exists and is readable
 	info, err := os.Stat(path)
-	if err != nil || info.IsDir() {
-		return false
+	if err != nil {
+		return false, fmt.Sprintf("cannot be read: %v", err)
+	}
+	if info.IsDir() {
+		return false, "is a directory"
 	}
 
 	// Check file size (skip files larger than 10MB)
 	if info.Size() > 10*1024*1024 {
-		return false
+		return false, fmt.Sprintf("too large: %.2f MB", float64(info.Size())/(1024*1024))
 	}
 
 	// Check if file is in an excluded directory
-	dirPath := filepath.Dir(path)
-	for _, excludedDir := range DefaultExcludedDirs {
-		if strings.Contains(dirPath, excludedDir) {
-			return false
-		}
+	if excludedDir, ok := excludedDirOf(filepath.Dir(path)); ok {
+		return false, fmt.Sprintf("in excluded directory %s", excludedDir)
 	}
 
 	// Check if file has an excluded extension
 	ext := strings.ToLower(filepath.Ext(path))
 	for _, excludedExt := range DefaultExcludedExtensions {
 		if ext == excludedExt {
-			return false
+			return false, fmt.Sprintf("excluded extension %s", ext)
 		}
 	}
 
-	return true
+	return true, ""
 }
 
-// IsTextFile attempts to determine if a file is a text file
-func IsTextFile(path string) bool {
-	// Common text file extensions
-	textExtensions := []string{
-		".txt", ".md", ".json", ".xml", ".html", ".htm", ".css", ".js",
-		".go", ".py", ".java", ".c", ".cpp", ".h", ".hpp", ".cs", ".php",
-		".rb", ".pl", ".sh", ".bat", ".ps1", ".yaml", ".yml", ".toml",
-		".ini", ".cfg", ".conf", ".log", ".csv", ".tsv",
+// excludedDirOf returns the name of the excluded directory, either a project
+// cache directory or one of DefaultExcludedDirs, that dir is or lies beneath.
+// Only whole path components match, so that directories whose names merely
+// contain one, such as cabinet or .indexer-old, are still indexed.
+func excludedDirOf(dir string) (string, bool) {
+	for _, part := range strings.Split(filepath.ToSlash(dir), "/") {
+		if part == ProjectCacheDir {
+			return part, true
+		}
+		for _, excludedDir := range DefaultExcludedDirs {
+			if part == excludedDir {
+				return part, true
+			}
+		}
 	}
+	return "", false
+}
 
+// IsTextFile attempts to determine if a file is a text file. Known text
+// extensions are trusted; anything else is decided by sniffing its content.
+func IsTextFile(path string) bool {
+	ok, _ := textReason(path)
+	return ok
+}
+
+// textReason is like IsTextFile but also describes what decided the outcome
+func textReason(path string) (bool, string) {
 	ext := strings.ToLower(filepath.Ext(path))
-	for _, textExt := range textExtensions {
+	for _, textExt := range TextExtensions {
 		if ext == textExt {
-			return true
+			return true, fmt.Sprintf("text extension %s", ext)
 		}
 	}
 
-	// For files without recognized extensions, we could check the content
-	// to determine if it's text, but for simplicity we'll just rely on extensions
+	file, err := os.Open(path)
+	if err != nil {
+		return false, fmt.Sprintf("cannot be read: %v", err)
+	}
+	defer file.Close()
+
+	head := make([]byte, sniffSize)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return false, fmt.Sprintf("cannot be read: %v", err)
+	}
+	head = head[:n]
+
+	if len(head) == 0 {
+		return true, "empty file"
+	}
+	if bytes.IndexByte(head, 0) >= 0 {
+		return false, "content contains NUL bytes"
+	}
+	if validUTF8Prefix(head) {
+		return true, "content is valid UTF-8"
+	}
+	contentType := http.DetectContentType(head)
+	return strings.HasPrefix(contentType, "text/"), fmt.Sprintf("content type %s", contentType)
+}
+
+// validUTF8Prefix reports whether b is valid UTF-8, allowing the last rune
+// to be cut short by the end of the sniffed prefix
+func validUTF8Prefix(b []byte) bool {
+	for i := 0; i < utf8.UTFMax && i < len(b); i++ {
+		end := len(b) - i
+		if utf8.Valid(b[:end]) {
+			return i == 0 || !utf8.FullRune(b[end:])
+		}
+	}
 	return false
 }
+
+// ExplainFile reports whether a file would be indexed and why, using the
+// ignore rules of the indexed root containing it, or of its own directory
+func (idx *Indexer) ExplainFile(path string) (bool, string) {
+	rootDir := filepath.Dir(path)
+	idx.mutex.RLock()
+	best := ""
+	for root := range idx.index.Roots {
+		if isWithinRoot(path, root) && len(root) > len(best) {
+			best = root
+		}
+	}
+	idx.mutex.RUnlock()
+	if best != "" {
+		rootDir = best
+	}
+
+	// Replay the walk from the root down to the file's directory
+	matcher := NewIgnoreMatcher(rootDir)
+	matcher.AddDir(rootDir)
+	var dirs []string
+	for dir := filepath.Dir(path); dir != rootDir; dir = filepath.Dir(dir) {
+		dirs = append(dirs, dir)
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if ignored, source := matcher.Match(dirs[i], true); ignored {
+			return false, fmt.Sprintf("inside directory %s, ignored by %s", dirs[i], source)
+		}
+		matcher.AddDir(dirs[i])
+	}
+	if ignored, source := matcher.Match(path, false); ignored {
+		return false, fmt.Sprintf("ignored by %s", source)
+	}
+
+	if ok, reason := indexReason(path); !ok {
+		return false, reason
+	}
+	ok, reason := textReason(path)
+	if !ok {
+		return false, "binary: " + reason
+	}
+	return true, "text: " + reason
+}
+
+// isWithinRoot reports whether path is the root directory itself or lies beneath it
+func isWithinRoot(path, root string) bool {
+	if path == root {
+		return true
+	}
+	if !strings.HasSuffix(root, string(os.PathSeparator)) {
+		root += string(os.PathSeparator)
+	}
+	return strings.HasPrefix(path, root)
+}
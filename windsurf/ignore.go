@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// IgnoreFiles are read from every directory, in increasing order of precedence
+var IgnoreFiles = []string{".gitignore", ".indexignore"}
+
+// ignoreRule is a single compiled ignore pattern
+type ignoreRule struct {
+	re      *regexp.Regexp
+	negate  bool   // Pattern started with '!' and re-includes matches
+	dirOnly bool   // Pattern ended with '/' and only matches directories
+	base    string // Directory the pattern is relative to
+	source  string // File, line and text of the pattern, for explanations
+}
+
+// IgnoreMatcher decides which paths are ignored according to .gitignore files,
+// .git/info/exclude and .indexignore files. Ignore files are read per
+// directory with AddDir as a walk reaches them. An IgnoreMatcher is not safe for
+// concurrent use.
+type IgnoreMatcher struct {
+	top     string                  // Outermost directory whose rules apply
+	exclude []ignoreRule            // Rules from .git/info/exclude
+	dirs    map[string][]ignoreRule // Rules from the ignore files of each directory
+}
+
+// NewIgnoreMatcher creates a matcher for a walk starting at root. When root is inside a
+// git repository, the repository's .git/info/exclude and the ignore files of
+// the directories between the repository root and root are loaded as well.
+func NewIgnoreMatcher(root string) *IgnoreMatcher {
+	root = filepath.Clean(root)
+	m := &IgnoreMatcher{
+		top:  root,
+		dirs: make(map[string][]ignoreRule),
+	}
+
+	repo, ok := findRepoRoot(root)
+	if !ok {
+		return m
+	}
+	m.top = repo
+	m.exclude = readRules(filepath.Join(repo, ".git", "info", "exclude"), repo)
+
+	// Load the ignore files of the directories above root, top down
+	if root != repo {
+		var parents []string
+		for dir := filepath.Dir(root); ; dir = filepath.Dir(dir) {
+			parents = append(parents, dir)
+			if dir == repo {
+				break
+			}
+		}
+		for i := len(parents) - 1; i >= 0; i-- {
+			m.AddDir(parents[i])
+		}
+	}
+	return m
+}
+
+// findRepoRoot looks for a directory containing .git, starting at dir and walking up
+func findRepoRoot(dir string) (string, bool) {
+	for {
+		if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+			return dir, true
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", false
+		}
+		dir = parent
+	}
+}
+
+// AddDir reads the ignore files of a directory. Missing files are not an error.
+func (m *IgnoreMatcher) AddDir(dir string) {
+	dir = filepath.Clean(dir)
+	if _, ok := m.dirs[dir]; ok {
+		return
+	}
+
+	var rules []ignoreRule
+	for _, name := range IgnoreFiles {
+		rules = append(rules, readRules(filepath.Join(dir, name), dir)...)
+	}
+	m.dirs[dir] = rules
+}
+
+// Ignored reports whether a path is excluded by the rules loaded so far.
+// Rules from deeper directories take precedence over those above them, and
+// within a directory the last matching pattern wins. Only the path itself is
+// checked; callers walking a tree skip ignored directories entirely.
+func (m *IgnoreMatcher) Ignored(path string, isDir bool) bool {
+	ignored, _ := m.Match(path, isDir)
+	return ignored
+}
+
+// Match is like Ignored but also describes the pattern that decided the
+// outcome, or returns an empty description when no pattern matched
+func (m *IgnoreMatcher) Match(path string, isDir bool) (bool, string) {
+	path = filepath.Clean(path)
+
+	// Collect the directories from the top down to the path's parent
+	var dirs []string
+	for dir := filepath.Dir(path); isWithinRoot(dir, m.top); dir = filepath.Dir(dir) {
+		dirs = append(dirs, dir)
+		if dir == m.top {
+			break
+		}
+	}
+
+	ignored := false
+	source := ""
+	apply := func(rules []ignoreRule) {
+		for i := range rules {
+			if rules[i].matches(path, isDir) {
+				ignored = !rules[i].negate
+				source = rules[i].source
+			}
+		}
+	}
+
+	apply(m.exclude)
+	for i := len(dirs) - 1; i >= 0; i-- {
+		apply(m.dirs[dirs[i]])
+	}
+	return ignored, source
+}
+
+// matches reports whether the rule applies to path
+func (r *ignoreRule) matches(path string, isDir bool) bool {
+	if r.dirOnly && !isDir {
+		return false
+	}
+	rel, err := filepath.Rel(r.base, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(os.PathSeparator)) {
+		return false
+	}
+	return r.re.MatchString(filepath.ToSlash(rel))
+}
+
+// readRules parses an ignore file, returning no rules if it cannot be read
+func readRules(path, base string) []ignoreRule {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+
+	var rules []ignoreRule
+	scanner := bufio.NewScanner(file)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		if r, ok := parseRule(scanner.Text(), base); ok {
+			r.source = fmt.Sprintf("%s:%d: %s", path, lineNum, strings.TrimSpace(scanner.Text()))
+			rules = append(rules, r)
+		}
+	}
+	return rules
+}
+
+// parseRule compiles a single gitignore pattern line
+func parseRule(line, base string) (ignoreRule, bool) {
+	line = strings.TrimSuffix(line, "\r")
+
+	// Trailing spaces are ignored unless escaped with a backslash
+	if !strings.HasSuffix(line, `\ `) {
+		line = strings.TrimRight(line, " \t")
+	}
+	if line == "" || strings.HasPrefix(line, "#") {
+		return ignoreRule{}, false
+	}
+
+	r := ignoreRule{base: base}
+	if strings.HasPrefix(line, "!") {
+		r.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\!`) || strings.HasPrefix(line, `\#`) {
+		line = line[1:]
+	}
+
+	if strings.HasSuffix(line, "/") {
+		r.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return ignoreRule{}, false
+	}
+
+	// A slash anywhere but at the end anchors the pattern to its directory;
+	// otherwise it matches a name at any depth
+	anchored := strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+
+	expr := globToRegexp(line)
+	if anchored {
+		expr = "^" + expr + "$"
+	} else {
+		expr = "^(?:.*/)?" + expr + "$"
+	}
+
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return ignoreRule{}, false
+	}
+	r.re = re
+	return r, true
+}
+
+// globToRegexp translates a gitignore glob into a regular expression.
+// "*" and "?" do not cross directory separators, while "**" as a whole
+// path segment matches any number of directories.
+func globToRegexp(glob string) string {
+	var b strings.Builder
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch c {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				atStart := i == 0 || glob[i-1] == '/'
+				atEnd := i+2 == len(glob) || glob[i+2] == '/'
+				switch {
+				case atStart && i+2 == len(glob):
+					// Trailing "**" matches everything inside
+					b.WriteString(".*")
+					i++
+					continue
+				case atStart && atEnd:
+					// "**/" matches zero or more directories
+					b.WriteString("(?:.*/)?")
+					i += 2
+					continue
+				}
+				// Any other "**" behaves like a single "*"
+				i++
+			}
+			b.WriteString("[^/]*")
+		case '?':
+			b.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end == 0 {
+				// A ']' right after '[' is part of the class
+				if next := strings.IndexByte(glob[i+2:], ']'); next >= 0 {
+					end = next + 1
+				} else {
+					end = -1
+				}
+			}
+			if end < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += end + 1
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+				b.WriteString(regexp.QuoteMeta(string(glob[i])))
+			}
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return b.String()
+}
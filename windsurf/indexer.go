@@ -1,31 +1,93 @@
 package main
 
 import (
-	"bufio"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/crc32"
+	"io"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
-// SearchResult represents a single search result with file path and line number
+// SearchResult represents a single search result with file path, line number
+// and line text. Regular expression searches also report the column span of the match.
 type SearchResult struct {
-	FilePath   string `json:"filePath"`
-	LineNumber int    `json:"lineNumber"`
+	FilePath   string  `json:"filePath"`
+	LineNumber int     `json:"lineNumber"`
+	Text       string  `json:"text"`
+	Column     int     `json:"column,omitempty"`    // 1-based byte column where the match starts
+	EndColumn  int     `json:"endColumn,omitempty"` // 1-based byte column just past the match
+	Score      float64 `json:"score,omitempty"`     // BM25 relevance of the file when ranked
 }
 
-// FileIndex represents the index data for a single file
+// FileIndex represents the index data for a single file. The content is
+// stored once and read line by line through the methods in lines.go.
 type FileIndex struct {
-	Path     string            `json:"path"`
-	LineMap  map[int]string    `json:"lineMap"`
-	Modified int64             `json:"modified"`
+	Path     string         `json:"path"`
+	Content  string         `json:"content"`
+	Modified int64          `json:"modified"`
+	Words    int            `json:"words"`             // Number of whitespace-separated words, the length used by Rank
+	LineMap  map[int]string `json:"lineMap,omitempty"` // Only in indexes saved before format version 1
+
+	lineStarts []uint32 // Byte offset of the start of every line
+}
+
+// RootInfo describes a directory that has been added to the index
+type RootInfo struct {
+	Path      string    `json:"path"`
+	Files     int       `json:"files"`
+	IndexedAt time.Time `json:"indexedAt"`
 }
 
-// Index represents the entire index data structure
+// Version is the version of indexer, recorded in the indexes it saves
+const Version = "1.0.0"
+
+// indexVersion is the version of the index file format. Indexes saved
+// before the format was versioned have version 0.
+const indexVersion = 1
+
+// From format version 1 an index file starts with a checksum field of fixed
+// width, holding the CRC-32 of everything after it in hexadecimal, so that
+// a damaged file is detected even when it is still valid JSON
+const (
+	checksumPrefix = `{"checksum":"`
+	checksumSize   = len(checksumPrefix) + 8 + len(`",`)
+)
+
+// migrations upgrade a decoded index from the format version at their
+// position to the next one
+var migrations = []func(index *Index){
+	// 0: roots were not tracked and files were stored line by line
+	func(index *Index) {
+		index.Roots = make(map[string]*RootInfo)
+		for _, fileIndex := range index.Files {
+			fileIndex.Content = contentFromLineMap(fileIndex.LineMap)
+			fileIndex.Words = len(strings.Fields(fileIndex.Content))
+			fileIndex.LineMap = nil
+		}
+	},
+}
+
+// ErrNewerIndex is returned when loading an index saved by a newer version of
+// indexer, which this version cannot read without losing data
+var ErrNewerIndex = errors.New("index is from a newer version of indexer")
+
+// Index represents the entire index data structure. The header fields
+// describe the format and the indexer that saved it.
 type Index struct {
-	Files map[string]*FileIndex `json:"files"`
+	Version     int                   `json:"version"`
+	ToolVersion string                `json:"toolVersion,omitempty"`
+	CreatedAt   time.Time             `json:"createdAt"`
+	Roots       map[string]*RootInfo  `json:"roots"`
+	Files       map[string]*FileIndex `json:"files"`
 }
 
 // Indexer handles file indexing and searching operations
@@ -35,26 +97,36 @@ type Indexer struct {
 	mutex         sync.RWMutex
 }
 
-// NewIndexer creates a new instance of Indexer
-func NewIndexer() *Indexer {
-	homeDir, err := os.UserHomeDir()
-	if err != nil {
-		homeDir = "."
-	}
-	
-	indexFilePath := filepath.Join(homeDir, ".indexer_data.json")
-	
+// NewIndexer creates a new instance of Indexer for the named index in cacheDir
+func NewIndexer(cacheDir, name string) *Indexer {
+	indexFilePath := indexPath(cacheDir, name)
+
 	return &Indexer{
 		index: Index{
 			Files: make(map[string]*FileIndex),
+			Roots: make(map[string]*RootInfo),
 		},
 		indexFilePath: indexFilePath,
 		mutex:         sync.RWMutex{},
 	}
 }
 
-// IndexDirectory recursively indexes all files in the specified directory
+// IndexDirectory recursively indexes all files in the specified directory and
+// records it as a root. Files indexed from other roots are kept, while files
+// that have disappeared from this root are removed. It returns the number of
+// files indexed under the root.
 func (idx *Indexer) IndexDirectory(rootDir string) (int, error) {
+	return idx.IndexDirectoryContext(context.Background(), rootDir)
+}
+
+// IndexDirectoryContext is like IndexDirectory but stops walking once ctx is
+// done and returns its error after the workers have finished. Files indexed
+// until then are kept, but the root is not updated and the index should not
+// be saved.
+func (idx *Indexer) IndexDirectoryContext(ctx context.Context, rootDir string) (int, error) {
+	rootDir = filepath.Clean(rootDir)
+	seen := make(map[string]bool)
+
 	filesChan := make(chan string)
 	errorsChan := make(chan error)
 	resultsChan := make(chan *FileIndex)
@@ -94,30 +166,54 @@ func (idx *Indexer) IndexDirectory(rootDir string) (int, error) {
 		close(done)
 	}()
 
-	// Walk the directory tree
+	// Walk the directory tree, honouring .gitignore and .indexignore files
+	matcher := NewIgnoreMatcher(rootDir)
 	go func() {
 		err := filepath.Walk(rootDir, func(path string, info os.FileInfo, err error) error {
 			if err != nil {
-				return err
+				// Report a path that cannot be read and carry on with the rest
+				if path == rootDir {
+					return err
+				}
+				errorsChan <- fmt.Errorf("error walking %s: %w", path, err)
+				return nil
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
 			}
 
-			// Skip directories
+			// Skip ignored directories entirely and load the ignore files of the rest
 			if info.IsDir() {
+				if path != rootDir && matcher.Ignored(path, true) {
+					return filepath.SkipDir
+				}
+				matcher.AddDir(path)
+				return nil
+			}
+
+			if matcher.Ignored(path, false) {
 				return nil
 			}
 
 			// Use utility functions to determine if file should be indexed
 			if ShouldIndexFile(path) && IsTextFile(path) {
-				filesChan <- path
+				seen[path] = true
+				select {
+				case filesChan <- path:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
 			}
 			
 			return nil
 		})
 
 		close(filesChan)
-		if err != nil {
+		if err != nil && ctx.Err() == nil {
 			errorsChan <- err
 		}
+		// Workers may still be reporting errors until they have finished
+		wg.Wait()
 		close(errorsChan)
 	}()
 
@@ -129,12 +225,92 @@ func (idx *Indexer) IndexDirectory(rootDir string) (int, error) {
 
 	// Wait for result collection to finish
 	<-done
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	// Drop files under this root that no longer exist or are no longer indexable
+	idx.mutex.Lock()
+	count := 0
+	for path := range idx.index.Files {
+		if !isWithinRoot(path, rootDir) {
+			continue
+		}
+		if !seen[path] {
+			delete(idx.index.Files, path)
+			continue
+		}
+		count++
+	}
+	idx.index.Roots[rootDir] = &RootInfo{
+		Path:      rootDir,
+		Files:     count,
+		IndexedAt: time.Now(),
+	}
+	idx.mutex.Unlock()
 
 	if len(indexingErrors) > 0 {
-		return len(idx.index.Files), fmt.Errorf("encountered %d errors during indexing", len(indexingErrors))
+		return count, fmt.Errorf("encountered %d errors during indexing", len(indexingErrors))
 	}
 
-	return len(idx.index.Files), nil
+	return count, nil
+}
+
+// Roots returns the indexed roots sorted by path
+func (idx *Indexer) Roots() []RootInfo {
+	idx.mutex.RLock()
+	defer idx.mutex.RUnlock()
+
+	roots := make([]RootInfo, 0, len(idx.index.Roots))
+	for _, root := range idx.index.Roots {
+		info := *root
+		info.Files = 0
+		for path := range idx.index.Files {
+			if isWithinRoot(path, root.Path) {
+				info.Files++
+			}
+		}
+		roots = append(roots, info)
+	}
+
+	sort.Slice(roots, func(i, j int) bool {
+		return roots[i].Path < roots[j].Path
+	})
+	return roots
+}
+
+// Forget removes a root along with its files, keeping any file that is still
+// covered by another root. It returns the number of files removed.
+func (idx *Indexer) Forget(rootDir string) (int, error) {
+	rootDir = filepath.Clean(rootDir)
+
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+
+	if _, ok := idx.index.Roots[rootDir]; !ok {
+		return 0, fmt.Errorf("%s is not an indexed directory", rootDir)
+	}
+	delete(idx.index.Roots, rootDir)
+
+	removed := 0
+	for path := range idx.index.Files {
+		if !isWithinRoot(path, rootDir) {
+			continue
+		}
+		covered := false
+		for other := range idx.index.Roots {
+			if isWithinRoot(path, other) {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			delete(idx.index.Files, path)
+			removed++
+		}
+	}
+
+	return removed, nil
 }
 
 // indexFile indexes a single file
@@ -150,75 +326,223 @@ func (idx *Indexer) indexFile(filePath string) (*FileIndex, error) {
 		return nil, err
 	}
 
-	fileIndex := &FileIndex{
-		Path:     filePath,
-		LineMap:  make(map[int]string),
-		Modified: info.ModTime().Unix(),
-	}
-
-	scanner := bufio.NewScanner(file)
-	lineNum := 1
-
-	for scanner.Scan() {
-		fileIndex.LineMap[lineNum] = scanner.Text()
-		lineNum++
-	}
-
-	if err := scanner.Err(); err != nil {
+	var content strings.Builder
+	content.Grow(int(info.Size()))
+	if _, err := io.Copy(&content, file); err != nil {
 		return nil, err
 	}
 
-	return fileIndex, nil
+	return newFileIndex(filePath, content.String(), info.ModTime().Unix()), nil
 }
 
-// Search finds all occurrences of a keyword in the indexed files
-func (idx *Indexer) Search(keyword string) ([]SearchResult, error) {
+// Search finds all occurrences of a keyword in the indexed files, searching
+// with jobs workers, or one per CPU if jobs is not positive
+func (idx *Indexer) Search(keyword string, jobs int) ([]SearchResult, error) {
+	return idx.SearchContext(context.Background(), keyword, jobs)
+}
+
+// SearchContext is like Search but gives up once ctx is done, returning its error
+func (idx *Indexer) SearchContext(ctx context.Context, keyword string, jobs int) ([]SearchResult, error) {
 	keyword = strings.ToLower(keyword)
-	var results []SearchResult
 
 	idx.mutex.RLock()
 	defer idx.mutex.RUnlock()
 
-	for _, fileIndex := range idx.index.Files {
-		for lineNum, lineText := range fileIndex.LineMap {
+	return idx.searchFiles(ctx, jobs, func(fileIndex *FileIndex, results []SearchResult) []SearchResult {
+		for lineNum, lineText := range fileIndex.Lines() {
 			if strings.Contains(strings.ToLower(lineText), keyword) {
 				results = append(results, SearchResult{
 					FilePath:   fileIndex.Path,
 					LineNumber: lineNum,
+					Text:       lineText,
 				})
 			}
 		}
+		return results
+	})
+}
+
+// SearchRegex finds every match of a regular expression in the indexed
+// files, searching with jobs workers, or one per CPU if jobs is not positive
+func (idx *Indexer) SearchRegex(pattern string, jobs int) ([]SearchResult, error) {
+	return idx.SearchRegexContext(context.Background(), pattern, jobs)
+}
+
+// SearchRegexContext is like SearchRegex but gives up once ctx is done,
+// returning its error
+func (idx *Indexer) SearchRegexContext(ctx context.Context, pattern string, jobs int) ([]SearchResult, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
 	}
 
-	return results, nil
+	idx.mutex.RLock()
+	defer idx.mutex.RUnlock()
+
+	return idx.searchFiles(ctx, jobs, func(fileIndex *FileIndex, results []SearchResult) []SearchResult {
+		for lineNum, lineText := range fileIndex.Lines() {
+			for _, span := range re.FindAllStringIndex(lineText, -1) {
+				results = append(results, SearchResult{
+					FilePath:   fileIndex.Path,
+					LineNumber: lineNum,
+					Text:       lineText,
+					Column:     span[0] + 1,
+					EndColumn:  span[1] + 1,
+				})
+			}
+		}
+		return results
+	})
 }
 
-// SaveIndex persists the index to a file
+// SaveIndex persists the index to a file. The index is written to a
+// temporary file that replaces the index file only once it is complete and
+// flushed to disk, and the replaced file is kept as the previous generation.
 func (idx *Indexer) SaveIndex() error {
 	idx.mutex.RLock()
 	defer idx.mutex.RUnlock()
 
-	file, err := os.Create(idx.indexFilePath)
+	dir := filepath.Dir(idx.indexFilePath)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(dir, filepath.Base(idx.indexFilePath)+".*.tmp")
 	if err != nil {
 		return err
 	}
+	tmpPath := file.Name()
+	defer os.Remove(tmpPath)
 	defer file.Close()
 
-	encoder := json.NewEncoder(file)
-	return encoder.Encode(idx.index)
+	if err := file.Chmod(0644); err != nil {
+		return err
+	}
+	index := idx.index
+	index.Version = indexVersion
+	index.ToolVersion = Version
+	index.CreatedAt = time.Now()
+	data, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	// Put the checksum of the rest in place of the opening brace
+	body := append(data[1:], '\n')
+	header := fmt.Sprintf("%s%08x\",", checksumPrefix, crc32.ChecksumIEEE(body))
+	if _, err := file.WriteString(header); err != nil {
+		return err
+	}
+	if _, err := file.Write(body); err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(idx.indexFilePath, idx.indexFilePath+".prev"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Rename(tmpPath, idx.indexFilePath); err != nil {
+		return err
+	}
+	syncDir(dir)
+	return nil
+}
+
+// syncDir flushes a directory so that renames within it survive a crash.
+// Not every platform supports this, so failures are ignored.
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
 }
 
-// LoadIndex loads the index from a file
+// LoadIndex loads the index from a file, migrating it from an older format
+// and falling back to the previous generation if the file is missing, cannot
+// be decoded or fails its checksum. An index from a newer version of indexer is an error
+// matching ErrNewerIndex.
 func (idx *Indexer) LoadIndex() error {
 	idx.mutex.Lock()
 	defer idx.mutex.Unlock()
 
-	file, err := os.Open(idx.indexFilePath)
-	if err != nil {
+	index, err := readIndexFile(idx.indexFilePath)
+	if errors.Is(err, ErrNewerIndex) {
 		return err
 	}
-	defer file.Close()
+	if err != nil {
+		previous, prevErr := readIndexFile(idx.indexFilePath + ".prev")
+		if prevErr != nil {
+			return err
+		}
+		if !os.IsNotExist(err) {
+			fmt.Printf("Warning: %v; using the previous index generation\n", err)
+		}
+		index = previous
+	}
+	for _, migrate := range migrations[index.Version:] {
+		migrate(index)
+	}
+	if index.Files == nil {
+		index.Files = make(map[string]*FileIndex)
+	}
+	for _, fileIndex := range index.Files {
+		fileIndex.indexLines()
+	}
+	idx.index = *index
+	return nil
+}
+
+// readIndexFile decodes an index file, checking its format version before
+// decoding the rest since a newer format may not fit the Index struct, and
+// verifying its checksum from format version 1
+func readIndexFile(path string) (*Index, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var header struct {
+		Version     int    `json:"version"`
+		ToolVersion string `json:"toolVersion"`
+	}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %w", path, err)
+	}
+	if header.Version > indexVersion {
+		return nil, fmt.Errorf("%w: %s was saved by indexer %s in format version %d, but this is indexer %s, which reads up to version %d",
+			ErrNewerIndex, path, header.ToolVersion, header.Version, Version, indexVersion)
+	}
+	if header.Version < 0 {
+		return nil, fmt.Errorf("%s has invalid format version %d", path, header.Version)
+	}
+	if header.Version > 0 {
+		if err := verifyChecksum(data); err != nil {
+			return nil, fmt.Errorf("%s is damaged: %w", path, err)
+		}
+	}
+
+	var index Index
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %w", path, err)
+	}
+	return &index, nil
+}
 
-	decoder := json.NewDecoder(file)
-	return decoder.Decode(&idx.index)
+// verifyChecksum checks the checksum at the start of an index file against
+// the rest of it
+func verifyChecksum(data []byte) error {
+	if len(data) < checksumSize || string(data[:len(checksumPrefix)]) != checksumPrefix {
+		return errors.New("checksum missing")
+	}
+	stored, err := strconv.ParseUint(string(data[len(checksumPrefix):checksumSize-2]), 16, 32)
+	if err != nil {
+		return errors.New("checksum missing")
+	}
+	if crc32.ChecksumIEEE(data[checksumSize:]) != uint32(stored) {
+		return errors.New("checksum mismatch")
+	}
+	return nil
 }
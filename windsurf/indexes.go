@@ -0,0 +1,266 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultIndex is the index used when none is selected. It is stored where
+// the single index of earlier versions was.
+const DefaultIndex = "default"
+
+// IndexEnv is the environment variable selecting an index when --index is not given
+const IndexEnv = "INDEXER_INDEX"
+
+// CacheDirEnv is the environment variable setting the directory holding the
+// indexes when --cache-dir is not given
+const CacheDirEnv = "INDEXER_CACHE_DIR"
+
+// ProjectCacheDir is the name of a project-local directory holding the
+// indexes, found in the working directory or one of its parents
+const ProjectCacheDir = ".indexer"
+
+// Index file locations, relative to the cache directory
+const (
+	defaultIndexFile = ".indexer_data.json"
+	namedIndexDir    = ".indexer_indexes" // Holds <name>.json for every other index
+)
+
+// indexNamePattern restricts names to ones that are safe as file names
+var indexNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// IndexSummary describes a saved index
+type IndexSummary struct {
+	Name     string
+	Size     int64
+	Modified time.Time
+}
+
+// validateIndexName checks that name can be used as an index name
+func validateIndexName(name string) error {
+	if !indexNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid index name %q: use letters, digits, '.', '_' and '-', starting with a letter or digit", name)
+	}
+	return nil
+}
+
+// indexPath returns the file holding the named index
+func indexPath(cacheDir, name string) string {
+	if name == DefaultIndex {
+		return filepath.Join(cacheDir, defaultIndexFile)
+	}
+	return filepath.Join(cacheDir, namedIndexDir, name+".json")
+}
+
+// resolveCacheDir returns the directory holding the indexes: dir if it is not
+// empty, then $INDEXER_CACHE_DIR, then a .indexer directory in the working
+// directory or one of its parents, then $XDG_CACHE_HOME/indexer, and finally
+// the home directory, where earlier versions kept the index
+func resolveCacheDir(dir string) (string, error) {
+	if dir != "" {
+		return filepath.Abs(dir)
+	}
+	if env := os.Getenv(CacheDirEnv); env != "" {
+		return filepath.Abs(env)
+	}
+
+	if wd, err := os.Getwd(); err == nil {
+		for {
+			candidate := filepath.Join(wd, ProjectCacheDir)
+			if info, err := os.Stat(candidate); err == nil && info.IsDir() {
+				return candidate, nil
+			}
+			parent := filepath.Dir(wd)
+			if parent == wd {
+				break
+			}
+			wd = parent
+		}
+	}
+
+	// Relative paths are invalid according to the XDG spec
+	if xdg := os.Getenv("XDG_CACHE_HOME"); filepath.IsAbs(xdg) {
+		return filepath.Join(xdg, "indexer"), nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("cannot find a directory for the index: use --cache-dir or set %s", CacheDirEnv)
+	}
+	return home, nil
+}
+
+// indexFlags adds the --index and --cache-dir flags to a command. The index
+// defaults to $INDEXER_INDEX and then to the default index.
+func indexFlags(fs *flag.FlagSet) (name, cacheDir *string) {
+	defaultName := os.Getenv(IndexEnv)
+	if defaultName == "" {
+		defaultName = DefaultIndex
+	}
+	name = fs.String("index", defaultName, "Use the index called `name` (default $"+IndexEnv+" or \""+DefaultIndex+"\")")
+	return name, cacheDirFlag(fs)
+}
+
+// cacheDirFlag adds the --cache-dir flag to a command
+func cacheDirFlag(fs *flag.FlagSet) *string {
+	return fs.String("cache-dir", "", "Keep indexes in `directory` (default $"+CacheDirEnv+", a "+ProjectCacheDir+" directory above the working directory, $XDG_CACHE_HOME/indexer or the home directory)")
+}
+
+// openCacheDir resolves the cache directory, exiting if there is none
+func openCacheDir(dir string) string {
+	cacheDir, err := resolveCacheDir(dir)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	return cacheDir
+}
+
+// openIndexer validates an index name and creates an Indexer for it in the
+// cache directory selected by dir
+func openIndexer(name, dir string) *Indexer {
+	if err := validateIndexName(name); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	return NewIndexer(openCacheDir(dir), name)
+}
+
+// ListIndexes returns the saved indexes sorted by name
+func ListIndexes(cacheDir string) ([]IndexSummary, error) {
+	var summaries []IndexSummary
+	if info, err := os.Stat(indexPath(cacheDir, DefaultIndex)); err == nil {
+		summaries = append(summaries, IndexSummary{Name: DefaultIndex, Size: info.Size(), Modified: info.ModTime()})
+	}
+
+	entries, err := os.ReadDir(filepath.Join(cacheDir, namedIndexDir))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok || entry.IsDir() || validateIndexName(name) != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		summaries = append(summaries, IndexSummary{Name: name, Size: info.Size(), Modified: info.ModTime()})
+	}
+
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].Name < summaries[j].Name
+	})
+	return summaries, nil
+}
+
+// DeleteIndex removes an index and its previous generation
+func DeleteIndex(cacheDir, name string) error {
+	path := indexPath(cacheDir, name)
+	if _, err := os.Stat(path); err != nil {
+		return fmt.Errorf("index %q does not exist", name)
+	}
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	if err := os.Remove(path + ".prev"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// RenameIndex renames an index, moving its previous generation with it
+func RenameIndex(cacheDir, oldName, newName string) error {
+	oldPath, newPath := indexPath(cacheDir, oldName), indexPath(cacheDir, newName)
+	if _, err := os.Stat(oldPath); err != nil {
+		return fmt.Errorf("index %q does not exist", oldName)
+	}
+	if _, err := os.Stat(newPath); err == nil {
+		return fmt.Errorf("index %q already exists", newName)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(newPath), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(oldPath, newPath); err != nil {
+		return err
+	}
+	// A stale previous generation under the new name would be loaded if the
+	// renamed index were ever damaged
+	os.Remove(newPath + ".prev")
+	if err := os.Rename(oldPath+".prev", newPath+".prev"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func handleIndexes() {
+	indexesCmd := flag.NewFlagSet("indexes", flag.ExitOnError)
+	dir := cacheDirFlag(indexesCmd)
+	indexesCmd.Parse(os.Args[2:])
+
+	if indexesCmd.NArg() < 1 {
+		fmt.Println("Error: indexes command requires list, delete or rename")
+		fmt.Println("Usage: indexer indexes [--cache-dir <dir>] list|delete <name>|rename <old> <new>")
+		os.Exit(1)
+	}
+
+	cacheDir := openCacheDir(*dir)
+	args := indexesCmd.Args()[1:]
+	for _, name := range args {
+		if err := validateIndexName(name); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	switch indexesCmd.Arg(0) {
+	case "list":
+		summaries, err := ListIndexes(cacheDir)
+		if err != nil {
+			fmt.Printf("Error listing indexes: %v\n", err)
+			os.Exit(1)
+		}
+		if len(summaries) == 0 {
+			fmt.Println("No indexes saved yet.")
+			return
+		}
+		fmt.Println("Indexes:")
+		for _, s := range summaries {
+			fmt.Printf(" - %s (%.2f MB, saved %s)\n", s.Name, float64(s.Size)/(1024*1024), s.Modified.Local().Format("2006-01-02 15:04:05"))
+		}
+
+	case "delete":
+		if len(args) != 1 {
+			fmt.Println("Usage: indexer indexes delete <name>")
+			os.Exit(1)
+		}
+		if err := DeleteIndex(cacheDir, args[0]); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Deleted index %s.\n", args[0])
+
+	case "rename":
+		if len(args) != 2 {
+			fmt.Println("Usage: indexer indexes rename <old> <new>")
+			os.Exit(1)
+		}
+		if err := RenameIndex(cacheDir, args[0], args[1]); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Renamed index %s to %s.\n", args[0], args[1])
+
+	default:
+		fmt.Printf("Error: unknown indexes subcommand %q\n", indexesCmd.Arg(0))
+		fmt.Println("Usage: indexer indexes list|delete <name>|rename <old> <new>")
+		os.Exit(1)
+	}
+}
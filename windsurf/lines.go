@@ -0,0 +1,92 @@
+package main
+
+import (
+	"iter"
+	"sort"
+	"strings"
+)
+
+// newFileIndex creates the index of a file holding content
+func newFileIndex(path, content string, modified int64) *FileIndex {
+	fileIndex := &FileIndex{
+		Path:     path,
+		Content:  content,
+		Modified: modified,
+		Words:    len(strings.Fields(content)),
+	}
+	fileIndex.indexLines()
+	return fileIndex
+}
+
+// indexLines records where every line of the content starts. A final
+// newline ends the last line rather than starting an empty one.
+func (f *FileIndex) indexLines() {
+	f.lineStarts = nil
+	if f.Content == "" {
+		return
+	}
+	f.lineStarts = make([]uint32, 1, strings.Count(f.Content, "\n")+1)
+	for i := 0; i < len(f.Content); i++ {
+		if f.Content[i] == '\n' && i+1 < len(f.Content) {
+			f.lineStarts = append(f.lineStarts, uint32(i+1))
+		}
+	}
+}
+
+// LineCount returns the number of lines in the file
+func (f *FileIndex) LineCount() int {
+	return len(f.lineStarts)
+}
+
+// Line returns line n, counting from 1, without its line ending, or an
+// empty string if there is no such line
+func (f *FileIndex) Line(n int) string {
+	if n < 1 || n > len(f.lineStarts) {
+		return ""
+	}
+	end := len(f.Content)
+	if n < len(f.lineStarts) {
+		end = int(f.lineStarts[n])
+	}
+	line := strings.TrimSuffix(f.Content[f.lineStarts[n-1]:end], "\n")
+	return strings.TrimSuffix(line, "\r")
+}
+
+// LineOf returns the number of the line containing the byte at offset, or 0
+// if the offset is outside the content
+func (f *FileIndex) LineOf(offset int) int {
+	if offset < 0 || offset >= len(f.Content) {
+		return 0
+	}
+	return sort.Search(len(f.lineStarts), func(i int) bool {
+		return int(f.lineStarts[i]) > offset
+	})
+}
+
+// Lines iterates over the lines of the file in order with their numbers
+func (f *FileIndex) Lines() iter.Seq2[int, string] {
+	return func(yield func(int, string) bool) {
+		for n := 1; n <= len(f.lineStarts); n++ {
+			if !yield(n, f.Line(n)) {
+				return
+			}
+		}
+	}
+}
+
+// contentFromLineMap joins lines keyed by their number, as indexes saved
+// before format version 1 stored them, into file content
+func contentFromLineMap(lineMap map[int]string) string {
+	lines := make([]string, len(lineMap))
+	for lineNum, line := range lineMap {
+		if lineNum >= 1 && lineNum <= len(lines) {
+			lines[lineNum-1] = line
+		}
+	}
+	content := strings.Join(lines, "\n")
+	if len(lines) > 0 && lines[len(lines)-1] == "" {
+		// Keep a final empty line, which joining alone would drop
+		content += "\n"
+	}
+	return content
+}
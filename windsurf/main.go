@@ -1,10 +1,17 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"runtime"
+	"syscall"
+	"time"
 )
 
 func main() {
@@ -18,6 +25,12 @@ func main() {
 		handleIndex()
 	case "search":
 		handleSearch()
+	case "roots":
+		handleRoots()
+	case "forget":
+		handleForget()
+	case "indexes":
+		handleIndexes()
 	default:
 		printUsage()
 		os.Exit(1)
@@ -27,13 +40,37 @@ func main() {
 func printUsage() {
 	fmt.Println("Usage:")
 	fmt.Println("  indexer index <directory_path>  - Index files in the specified directory")
+	fmt.Println("  indexer index --explain <file>  - Explain why a file is indexed or skipped")
 	fmt.Println("  indexer search <keyword>        - Search for keyword in indexed files")
+	fmt.Println("  indexer search --regex <pattern> - Search for a regular expression in indexed files")
+	fmt.Println("  indexer search --rank <keyword> - Order matching files by BM25 relevance")
+	fmt.Println("  indexer search -A/-B/-C <n> <keyword> - Print n lines of context after/before/around results")
+	fmt.Println("  indexer search --json <keyword> - Print results as JSON")
+	fmt.Println("  indexer search --jobs <n> <keyword> - Search with n workers (default: one per CPU)")
+	fmt.Println("  indexer search --timeout <d> <keyword> - Give up on the search after d, e.g. 2s")
+	fmt.Println("  indexer roots                   - List the indexed directories")
+	fmt.Println("  indexer forget <directory_path> - Remove a directory from the index")
+	fmt.Println("  indexer indexes list            - List the saved indexes")
+	fmt.Println("  indexer indexes delete <name>   - Delete an index")
+	fmt.Println("  indexer indexes rename <old> <new> - Rename an index")
+	fmt.Println()
+	fmt.Println("Every command except indexes accepts --index <name> to use a separate named index")
+	fmt.Println("(default $" + IndexEnv + ", or \"" + DefaultIndex + "\"). Every command accepts --cache-dir <dir>")
+	fmt.Println("to choose where indexes are kept (default $" + CacheDirEnv + ", then a " + ProjectCacheDir + " directory in the")
+	fmt.Println("working directory or a parent, then $XDG_CACHE_HOME/indexer, then the home directory).")
 }
 
 func handleIndex() {
 	indexCmd := flag.NewFlagSet("index", flag.ExitOnError)
+	explain := indexCmd.String("explain", "", "Explain why `file` is indexed or skipped instead of indexing")
+	indexName, cacheDir := indexFlags(indexCmd)
 	indexCmd.Parse(os.Args[2:])
 
+	if *explain != "" {
+		handleExplain(*explain, *indexName, *cacheDir)
+		return
+	}
+
 	if indexCmd.NArg() < 1 {
 		fmt.Println("Error: directory path required")
 		fmt.Println("Usage: indexer index <directory_path>")
@@ -47,8 +84,24 @@ func handleIndex() {
 		os.Exit(1)
 	}
 
-	indexer := NewIndexer()
-	count, err := indexer.IndexDirectory(dirPath)
+	indexer := openIndexer(*indexName, *cacheDir)
+	if err := indexer.LoadIndex(); errors.Is(err, ErrNewerIndex) {
+		// Saving would replace the newer index with an empty one
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	} else if err != nil && !os.IsNotExist(err) {
+		fmt.Printf("Warning: could not load existing index: %v\n", err)
+	}
+
+	// An interrupted run leaves the index incomplete, so the saved index is
+	// kept rather than replaced
+	ctx, cancel := interruptContext(0)
+	defer cancel()
+	count, err := indexer.IndexDirectoryContext(ctx, dirPath)
+	if ctx.Err() != nil {
+		fmt.Println("Indexing interrupted; the saved index was left unchanged")
+		os.Exit(1)
+	}
 	if err != nil {
 		fmt.Printf("Error during indexing: %v\n", err)
 		os.Exit(1)
@@ -63,28 +116,88 @@ func handleIndex() {
 	fmt.Printf("Indexed %d files successfully.\n", count)
 }
 
+func handleExplain(path, indexName, cacheDir string) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		fmt.Printf("Error resolving path: %v\n", err)
+		os.Exit(1)
+	}
+
+	indexer := openIndexer(indexName, cacheDir)
+	if err := indexer.LoadIndex(); err != nil && !os.IsNotExist(err) {
+		fmt.Printf("Warning: could not load existing index: %v\n", err)
+	}
+
+	included, reason := indexer.ExplainFile(absPath)
+	if included {
+		fmt.Printf("%s: indexed (%s)\n", path, reason)
+	} else {
+		fmt.Printf("%s: skipped (%s)\n", path, reason)
+	}
+}
+
+// interruptContext returns a context that is cancelled on SIGINT or SIGTERM
+// and, if timeout is positive, once it has elapsed
+func interruptContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	if timeout <= 0 {
+		return ctx, stop
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	return ctx, func() {
+		cancel()
+		stop()
+	}
+}
+
 func handleSearch() {
 	searchCmd := flag.NewFlagSet("search", flag.ExitOnError)
+	regex := searchCmd.Bool("regex", false, "Treat the keyword as a regular expression")
+	rank := searchCmd.Bool("rank", false, "Order files by BM25 relevance instead of by path")
+	after := searchCmd.Int("A", 0, "Print `N` lines of context after each result")
+	before := searchCmd.Int("B", 0, "Print `N` lines of context before each result")
+	around := searchCmd.Int("C", 0, "Print `N` lines of context around each result")
+	asJSON := searchCmd.Bool("json", false, "Print results as JSON")
+	jobs := searchCmd.Int("jobs", runtime.NumCPU(), "Search with `N` workers")
+	timeout := searchCmd.Duration("timeout", 0, "Give up on the search after `duration`, e.g. 500ms or 10s (0 for no limit)")
+	indexName, cacheDir := indexFlags(searchCmd)
 	searchCmd.Parse(os.Args[2:])
 
 	if searchCmd.NArg() < 1 {
 		fmt.Println("Error: search keyword required")
-		fmt.Println("Usage: indexer search <keyword>")
+		fmt.Println("Usage: indexer search [--regex] [--rank] [-A N] [-B N] [-C N] [--json] [--jobs N] [--timeout D] <keyword>")
 		os.Exit(1)
 	}
 
 	keyword := searchCmd.Arg(0)
 
-	indexer := NewIndexer()
+	indexer := openIndexer(*indexName, *cacheDir)
 	err := indexer.LoadIndex()
 	if err != nil {
 		fmt.Printf("Error loading index: %v\n", err)
-		fmt.Println("Have you indexed any directories yet?")
+		if !errors.Is(err, ErrNewerIndex) {
+			fmt.Println("Have you indexed any directories yet?")
+		}
 		os.Exit(1)
 	}
 
-	results, err := indexer.Search(keyword)
-	if err != nil {
+	ctx, cancel := interruptContext(*timeout)
+	defer cancel()
+
+	var results []SearchResult
+	if *regex {
+		results, err = indexer.SearchRegexContext(ctx, keyword, *jobs)
+	} else {
+		results, err = indexer.SearchContext(ctx, keyword, *jobs)
+	}
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		fmt.Printf("Error: search timed out after %s\n", *timeout)
+		os.Exit(1)
+	case errors.Is(err, context.Canceled):
+		fmt.Println("Search interrupted")
+		os.Exit(1)
+	case err != nil:
 		fmt.Printf("Error during search: %v\n", err)
 		os.Exit(1)
 	}
@@ -94,8 +207,130 @@ func handleSearch() {
 		return
 	}
 
+	if *rank {
+		indexer.Rank(keyword, results)
+	} else {
+		sortResults(results)
+	}
+
+	linesBefore := max(*before, *around)
+	linesAfter := max(*after, *around)
+	if linesBefore > 0 || linesAfter > 0 {
+		blocks := indexer.Context(results, linesBefore, linesAfter)
+		if *asJSON {
+			printJSON(blocks)
+		} else {
+			printContextBlocks(blocks)
+		}
+		return
+	}
+
+	if *asJSON {
+		printJSON(results)
+		return
+	}
+
 	fmt.Println("Found in:")
 	for _, result := range results {
-		fmt.Printf(" - %s:%d\n", result.FilePath, result.LineNumber)
+		if *rank {
+			fmt.Printf(" - %s:%d (score %.3f)\n", result.FilePath, result.LineNumber, result.Score)
+		} else if result.Column > 0 {
+			fmt.Printf(" - %s:%d:%d-%d\n", result.FilePath, result.LineNumber, result.Column, result.EndColumn)
+		} else {
+			fmt.Printf(" - %s:%d\n", result.FilePath, result.LineNumber)
+		}
 	}
 }
+
+// printContextBlocks prints blocks grouped by file, marking result lines
+// with ':' and context lines with '-', and separating blocks with "--"
+func printContextBlocks(blocks []ContextBlock) {
+	currentFile := ""
+	for _, block := range blocks {
+		if block.FilePath != currentFile {
+			currentFile = block.FilePath
+			fmt.Printf("%s:\n", block.FilePath)
+		} else {
+			fmt.Println("  --")
+		}
+
+		for _, line := range block.Lines {
+			if line.Match {
+				fmt.Printf("  %d: %s\n", line.LineNumber, line.Text)
+			} else {
+				fmt.Printf("  %d- %s\n", line.LineNumber, line.Text)
+			}
+		}
+	}
+}
+
+// printJSON writes v to stdout as indented JSON
+func printJSON(v any) {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(v); err != nil {
+		fmt.Printf("Error encoding results: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func handleRoots() {
+	rootsCmd := flag.NewFlagSet("roots", flag.ExitOnError)
+	indexName, cacheDir := indexFlags(rootsCmd)
+	rootsCmd.Parse(os.Args[2:])
+
+	indexer := openIndexer(*indexName, *cacheDir)
+	err := indexer.LoadIndex()
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Printf("Error loading index: %v\n", err)
+		os.Exit(1)
+	}
+
+	roots := indexer.Roots()
+	if len(roots) == 0 {
+		fmt.Println("No directories indexed yet.")
+		return
+	}
+
+	fmt.Println("Indexed directories:")
+	for _, root := range roots {
+		fmt.Printf(" - %s (%d files, last indexed %s)\n", root.Path, root.Files, root.IndexedAt.Local().Format("2006-01-02 15:04:05"))
+	}
+}
+
+func handleForget() {
+	forgetCmd := flag.NewFlagSet("forget", flag.ExitOnError)
+	indexName, cacheDir := indexFlags(forgetCmd)
+	forgetCmd.Parse(os.Args[2:])
+
+	if forgetCmd.NArg() < 1 {
+		fmt.Println("Error: directory path required")
+		fmt.Println("Usage: indexer forget <directory_path>")
+		os.Exit(1)
+	}
+
+	dirPath, err := filepath.Abs(forgetCmd.Arg(0))
+	if err != nil {
+		fmt.Printf("Error resolving path: %v\n", err)
+		os.Exit(1)
+	}
+
+	indexer := openIndexer(*indexName, *cacheDir)
+	if err := indexer.LoadIndex(); err != nil {
+		fmt.Printf("Error loading index: %v\n", err)
+		os.Exit(1)
+	}
+
+	removed, err := indexer.Forget(dirPath)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if err := indexer.SaveIndex(); err != nil {
+		fmt.Printf("Error saving index: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Forgot %s (%d files removed).\n", dirPath, removed)
+}
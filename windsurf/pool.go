@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// searchFiles runs search over every indexed file with a fixed number of
+// workers, jobs or runtime.NumCPU() if jobs is not positive. Each worker
+// appends the results of the files it takes to a batch of its own, and the
+// batches are joined once every worker is done. Workers stop taking files once
+// ctx is done, and its error is returned instead. The caller holds the read lock.
+func (idx *Indexer) searchFiles(ctx context.Context, jobs int, search func(fileIndex *FileIndex, batch []SearchResult) []SearchResult) ([]SearchResult, error) {
+	files := make([]*FileIndex, 0, len(idx.index.Files))
+	for _, fileIndex := range idx.index.Files {
+		files = append(files, fileIndex)
+	}
+
+	if jobs < 1 {
+		jobs = runtime.NumCPU()
+	}
+	jobs = min(jobs, len(files))
+
+	batches := make([][]SearchResult, jobs)
+	var next int64 = -1
+	var wg sync.WaitGroup
+	for w := range batches {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				i := atomic.AddInt64(&next, 1)
+				if i >= int64(len(files)) || ctx.Err() != nil {
+					return
+				}
+				batches[w] = search(files[i], batches[w])
+			}
+		}()
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var results []SearchResult
+	for _, batch := range batches {
+		results = append(results, batch...)
+	}
+	return results, nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// BM25 tuning parameters
+const (
+	bm25K1 = 1.2  // Term frequency saturation
+	bm25B  = 0.75 // Strength of file length normalisation
+)
+
+// Rank scores the file of every result with BM25 and orders the results best
+// file first. File length is the number of whitespace-separated words
+// recorded when the file was indexed, and a file's term frequency is the
+// number of words on its result lines that contain the keyword, or its number
+// of matches for regular expression results.
+func (idx *Indexer) Rank(keyword string, results []SearchResult) {
+	keyword = strings.ToLower(keyword)
+
+	idx.mutex.RLock()
+	freqs := make(map[string]int)
+	for _, result := range results {
+		if result.Column > 0 {
+			freqs[result.FilePath]++
+			continue
+		}
+		if fileIndex, ok := idx.index.Files[result.FilePath]; ok {
+			freqs[result.FilePath] += termFreq(fileIndex.Line(result.LineNumber), keyword)
+		}
+	}
+
+	lengths := make(map[string]int, len(freqs))
+	totalLength := 0
+	for path, fileIndex := range idx.index.Files {
+		if _, ok := freqs[path]; ok {
+			lengths[path] = fileIndex.Words
+		}
+		totalLength += fileIndex.Words
+	}
+	total := float64(len(idx.index.Files))
+	idx.mutex.RUnlock()
+
+	scores := make(map[string]float64, len(freqs))
+	if total > 0 && totalLength > 0 {
+		avgLength := float64(totalLength) / total
+		df := float64(len(freqs))
+		idf := math.Log(1 + (total-df+0.5)/(df+0.5))
+		for path, freq := range freqs {
+			tf := float64(freq)
+			norm := 1 - bm25B + bm25B*float64(lengths[path])/avgLength
+			scores[path] = idf * tf * (bm25K1 + 1) / (tf + bm25K1*norm)
+		}
+	}
+
+	for i := range results {
+		results[i].Score = scores[results[i].FilePath]
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		if a.Score != b.Score {
+			return a.Score > b.Score
+		}
+		if a.FilePath != b.FilePath {
+			return a.FilePath < b.FilePath
+		}
+		if a.LineNumber != b.LineNumber {
+			return a.LineNumber < b.LineNumber
+		}
+		return a.Column < b.Column
+	})
+}
+
+// termFreq counts the words of line that contain the lowercase keyword. A
+// keyword spanning several words counts once per occurrence instead.
+func termFreq(line, keyword string) int {
+	line = strings.ToLower(line)
+	if strings.ContainsFunc(keyword, unicode.IsSpace) {
+		return strings.Count(line, keyword)
+	}
+	count := 0
+	for _, word := range strings.Fields(line) {
+		if strings.Contains(word, keyword) {
+			count++
+		}
+	}
+	return count
+}
+
+// sortResults orders results by file path, line number and column
+func sortResults(results []SearchResult) {
+	sort.Slice(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		if a.FilePath != b.FilePath {
+			return a.FilePath < b.FilePath
+		}
+		if a.LineNumber != b.LineNumber {
+			return a.LineNumber < b.LineNumber
+		}
+		return a.Column < b.Column
+	})
+}